@@ -3,7 +3,10 @@ package config
 import (
     "encoding/json"
     "io"
+    "net"
     "os"
+    "path/filepath"
+    "strings"
 )
 
 type Configuration struct {
@@ -11,17 +14,83 @@ type Configuration struct {
     RemotePath                   string
     SftpServer                   string
     SftpPort                     string
+    SftpEndpoints                string // Comma-separated host[:port] list used instead of SftpServer, e.g. "sftp.example.com,dr.example.com:2222"
+    EndpointStrategy             string // "failover" (default, in listed order) or "round-robin"
     SftpUserName                 string
     SftpPassword                 string
+    PrivateKeyPath               string // RSA, ECDSA or Ed25519 private key for publickey auth
+    PrivateKeyPassphrase         string // Encrypted the same way as SftpPassword
+    CertificatePath              string // OpenSSH user certificate for PrivateKeyPath or an ssh-agent key
+    AuthMethods                  string // Comma-separated auth methods to try in order, e.g. "agent,publickey,password"
+    KeyboardInteractiveAnswers   map[string]string // Prompt substring -> answer, encrypted like SftpPassword
+    KnownHostsFile               string // OpenSSH known_hosts file used to verify the server
+    HostKeyFingerprints          string // Comma-separated pinned SHA256 fingerprints
+    TrustOnFirstUse              bool   // Record unknown host keys in KnownHostsFile, reject changed ones
+    Ciphers                      string // Comma-separated SSH ciphers to offer, in order, e.g. "aes256-gcm@openssh.com,aes128-cbc"
+    KeyExchanges                 string // Comma-separated key exchange algorithms, e.g. "curve25519-sha256,diffie-hellman-group14-sha1"
+    MACs                         string // Comma-separated MAC algorithms
+    HostKeyAlgorithms            string // Comma-separated host key algorithms
+    MaxPacketSize                int  // SFTP packet size in bytes, default 32768; OpenSSH accepts up to 262144
+    MaxConcurrentRequestsPerFile int  // SFTP requests in flight per file, default 64
+    DisableConcurrentReads       bool // Read downloads one request at a time
+    UseConcurrentWrites          bool // Write uploads with several requests in flight
+    UploadWorkers                int  // Files uploaded at once, default 1
+    DownloadWorkers              int  // Files downloaded at once, default 1
+    ResumeUploads                bool // Continue interrupted uploads from where they stopped
+    VerifyChecksums              bool // Compare hashes as well as sizes after each transfer
+    DownloadPartSuffix           string // Suffix of files still being downloaded, default ".part"
+    StalePartFileHours           int    // Delete partial downloads untouched this long, default 24
+    TransferConnections          int  // SFTP sessions the workers share, default 1
+    BandwidthLimitKBps           int               // Transfer speed cap for this customer in KiB/s, 0 means unlimited
+    BandwidthSchedule            []BandwidthWindow // Time-of-day caps that override BandwidthLimitKBps
+    GlobalBandwidthLimitKBps     int               // Set in the defaults entry: cap in KiB/s shared by all customers
+    GlobalBandwidthSchedule      []BandwidthWindow // Set in the defaults entry: time-of-day caps shared by all customers
+    JumpHosts                    []SSHHost // Bastions to tunnel through, in order, like ssh -J
+    Proxy                        string // socks5:// or http:// (CONNECT) proxy URL, "direct" to bypass ALL_PROXY
+    ProxyPassword                string // Proxy password, encrypted like SftpPassword
+    ConnectTimeoutSeconds        int     // TCP connect timeout per hop, default 30
+    HandshakeTimeoutSeconds      int     // SSH handshake and login timeout per hop, default 30
+    KeepAliveIntervalSeconds     int     // Send an SSH keepalive this often, 0 disables
+    KeepAliveMaxMissed           int     // Close the session after this many unanswered keepalives, default 3
+    RetryMaxAttempts             int     // Connection attempts for transient failures, default 1
+    RetryInitialBackoffSeconds   int     // Wait before the first retry, doubled after each one, default 5
+    RetryMaxBackoffSeconds       int     // Upper bound for the wait between retries, default 300
+    RetryJitter                  float64 // Fraction of each wait that is randomised, e.g. 0.2
     LogFilePath                  string
     ArchivePath                  string
     DeleteFoldersAfterArchive    bool
     FileExtensions               string
+    IncludePatterns              []string // Globs, or regular expressions prefixed "re:", on the relative path; only matching files are transferred
+    ExcludePatterns              []string // Globs or "re:" expressions for files and folders to leave out
+    MinFileSizeBytes             int64    // Skip smaller files, 0 means no limit
+    MaxFileSizeBytes             int64    // Skip larger files, 0 means no limit
+    MinFileAgeMinutes            int      // Skip files modified more recently, 0 means no limit
+    MaxFileAgeMinutes            int      // Skip files modified longer ago, 0 means no limit
+    StableAfterSeconds           int      // Defer uploading files modified more recently than this
+    StabilityCheckSeconds        int      // Defer files whose size or mtime changes over this many seconds
+    SkipFilesInUse               bool     // Defer files that are flock'ed or open for writing (Unix)
+    SourceMarkerSuffix           string   // Only transfer a file once name+suffix exists beside it, e.g. ".done"
+    DestinationMarkerSuffix      string   // Write an empty name+suffix beside each transferred file, e.g. ".ok"
+    MarkerCleanup                string   // "delete" (default) or "keep" the source marker after the transfer
+    MaxDepth                     int      // Levels of subfolders to transfer, 0 for all
+    FlattenFolders               bool     // Put every file in the destination folder itself instead of mirroring subfolders
+    PreserveTimestamps           bool     // Give transferred files the source's modification time
+    FileMode                     string   // Octal mode for transferred files, e.g. "0640"
+    DirMode                      string   // Octal mode for folders created for them, e.g. "0750"
+    Ownership                    string   // "uid:gid" to give transferred files, where permitted
+    OnConflict                   string   // When the remote file exists: overwrite (default), skip, fail, rename-timestamp, rename-counter, newer, different-size
+    TransferMode                 string   // "move" (default) archives uploads and may delete downloads; "sync" only sends new and changed files and leaves sources in place
+    StatePath                    string   // Folder for state shared by the job and the web server, default "<LogFilePath>/state"; use an absolute path
+    SyncStateFile                string   // Where a sync, or the ledger of downloads left on the server, remembers what was transferred, default "<StatePath>/<customer>-<upload|download>.json"
+    SyncCompare                  string   // How a sync or the download ledger spots changed files: "size-mtime" (default) or "hash"
+    SyncDeletes                  bool     // Have a sync delete the copies of files removed from the source
     CleanupThresholdDays         int
     UploadRootOnly               bool
     TempRemotePath               string
     UseTempFolder                bool
     NewExtension                 string
+    UploadPartSuffix             string // Upload as name+suffix in RemotePath, then rename, e.g. ".part"
+    RemoteNameTemplate           string // Name files are published under, default "{name}{ext}"
     DownloadEnabled              bool
     DownloadRemotePath           string
     DownloadLocalPath            string
@@ -31,25 +100,184 @@ type Configuration struct {
     Schedule                     string // Add a Schedule field for cron jobs
 }
 
+// BandwidthWindow caps transfers at LimitKBps between Start and End, given
+// as local "HH:MM". A window may run past midnight, e.g. 22:00 to 06:00.
+// A LimitKBps of 0 means unlimited.
+type BandwidthWindow struct {
+    Start     string
+    End       string
+    LimitKBps int
+}
+
+// SSHHost is an SSH server together with the credentials and host key
+// policy used to log in to it. Its fields mean the same as in Configuration.
+type SSHHost struct {
+    SftpServer                 string
+    SftpPort                   string
+    SftpUserName               string
+    SftpPassword               string
+    PrivateKeyPath             string
+    PrivateKeyPassphrase       string
+    CertificatePath            string
+    AuthMethods                string
+    KeyboardInteractiveAnswers map[string]string
+    KnownHostsFile             string
+    HostKeyFingerprints        string
+    TrustOnFirstUse            bool
+    Ciphers                    string
+    KeyExchanges               string
+    MACs                       string
+    HostKeyAlgorithms          string
+}
+
+// Target returns the customer's own SFTP server as an SSHHost.
+func (c Configuration) Target() SSHHost {
+    return SSHHost{
+        SftpServer:                 c.SftpServer,
+        SftpPort:                   c.SftpPort,
+        SftpUserName:               c.SftpUserName,
+        SftpPassword:               c.SftpPassword,
+        PrivateKeyPath:             c.PrivateKeyPath,
+        PrivateKeyPassphrase:       c.PrivateKeyPassphrase,
+        CertificatePath:            c.CertificatePath,
+        AuthMethods:                c.AuthMethods,
+        KeyboardInteractiveAnswers: c.KeyboardInteractiveAnswers,
+        KnownHostsFile:             c.KnownHostsFile,
+        HostKeyFingerprints:        c.HostKeyFingerprints,
+        TrustOnFirstUse:            c.TrustOnFirstUse,
+        Ciphers:                    c.Ciphers,
+        KeyExchanges:               c.KeyExchanges,
+        MACs:                       c.MACs,
+        HostKeyAlgorithms:          c.HostKeyAlgorithms,
+    }
+}
+
+// Endpoints returns the host:port addresses of the customer's SFTP server,
+// from SftpEndpoints when set and SftpServer otherwise. Endpoints without a
+// port use SftpPort.
+func (c Configuration) Endpoints() []string {
+    endpoints := []string{}
+    for _, endpoint := range strings.Split(c.SftpEndpoints, ",") {
+        endpoint = strings.TrimSpace(endpoint)
+        if endpoint == "" {
+            continue
+        }
+        if _, _, err := net.SplitHostPort(endpoint); err != nil {
+            endpoint = net.JoinHostPort(strings.Trim(endpoint, "[]"), c.SftpPort)
+        }
+        endpoints = append(endpoints, endpoint)
+    }
+    if len(endpoints) == 0 {
+        endpoints = append(endpoints, net.JoinHostPort(c.SftpServer, c.SftpPort))
+    }
+    return endpoints
+}
+
+// StateDir returns the folder where the job keeps state that the web
+// server reads too. The two run from different folders, so it only points
+// at the same place for both when StatePath, or LogFilePath, is absolute.
+func (c Configuration) StateDir() string {
+    if c.StatePath != "" {
+        return c.StatePath
+    }
+    return filepath.Join(c.LogFilePath, "state")
+}
+
+// StateFile returns where the customer's sync state, or ledger of
+// downloaded files, is kept. A relative SyncStateFile is inside StateDir.
+func (c Configuration) StateFile(customerName string) string {
+    if c.SyncStateFile != "" {
+        if filepath.IsAbs(c.SyncStateFile) {
+            return c.SyncStateFile
+        }
+        return filepath.Join(c.StateDir(), c.SyncStateFile)
+    }
+    direction := "upload"
+    if c.DownloadEnabled {
+        direction = "download"
+    }
+    return filepath.Join(c.StateDir(), customerName+"-"+direction+".json")
+}
+
+// LastRunFile returns where the job records the endpoint that served the
+// customer's latest run.
+func (c Configuration) LastRunFile(customerName string) string {
+    return filepath.Join(c.StateDir(), customerName+"-last-run.json")
+}
+
+// TracksDownloads reports whether the customer's downloads are recorded in
+// a state file: always in sync mode, and in move mode whenever remote files
+// are left on the server, so each one is only downloaded once.
+func (c Configuration) TracksDownloads() bool {
+    return c.DownloadEnabled && (c.TransferMode == "sync" || !c.DeleteRemoteFileAfterDownload)
+}
+
+// DefaultsKey names an optional entry in the configuration file whose
+// settings apply to every customer that does not set them itself.
+const DefaultsKey = "defaults"
+
 func LoadAllConfigs(filePath string) (map[string]Configuration, error) {
-    file, err := os.Open(filePath)
+    entries, defaults, err := loadEntries(filePath)
     if err != nil {
         return nil, err
     }
+
+    configs := make(map[string]Configuration)
+    for customerName, entry := range entries {
+        var config Configuration
+        if defaults != nil {
+            if err := json.Unmarshal(defaults, &config); err != nil {
+                return nil, err
+            }
+        }
+        if err := json.Unmarshal(entry, &config); err != nil {
+            return nil, err
+        }
+        configs[customerName] = config
+    }
+
+    return configs, nil
+}
+
+// LoadDefaults returns the defaults entry of the configuration file, which
+// is empty when the file has none.
+func LoadDefaults(filePath string) (Configuration, error) {
+    _, defaults, err := loadEntries(filePath)
+    if err != nil {
+        return Configuration{}, err
+    }
+
+    var config Configuration
+    if defaults != nil {
+        if err := json.Unmarshal(defaults, &config); err != nil {
+            return Configuration{}, err
+        }
+    }
+    return config, nil
+}
+
+// loadEntries reads the configuration file and splits off its defaults entry.
+func loadEntries(filePath string) (map[string]json.RawMessage, json.RawMessage, error) {
+    file, err := os.Open(filePath)
+    if err != nil {
+        return nil, nil, err
+    }
     defer file.Close()
 
-    var configs map[string]Configuration
+    var entries map[string]json.RawMessage
     bytes, err := io.ReadAll(file)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
 
-    err = json.Unmarshal(bytes, &configs)
+    err = json.Unmarshal(bytes, &entries)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
 
-    return configs, nil
+    defaults := entries[DefaultsKey]
+    delete(entries, DefaultsKey)
+    return entries, defaults, nil
 }
 
 func LoadConfig(customerName string) (Configuration, error) {
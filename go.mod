@@ -3,9 +3,13 @@ module sftphive
 go 1.22.0
 
 require (
-	github.com/kr/fs v0.1.0 // indirect
-	github.com/pkg/sftp v1.13.6 // indirect
+	github.com/pkg/sftp v1.13.6
 	github.com/robfig/cron/v3 v3.0.1
-	golang.org/x/crypto v0.1.0 // indirect
+	golang.org/x/crypto v0.1.0
+	golang.org/x/net v0.1.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/sys v0.1.0 // indirect
 )
@@ -7,7 +7,9 @@ import (
     "errors"
     "flag"
     "fmt"
+    "io"
     "log"
+    "net"
     "os"
     "path/filepath"
     "strconv"
@@ -21,10 +23,19 @@ import (
 
 var jobStatuses = make(map[string]string)
 
+// globalThrottle caps the bandwidth of all customers' transfers together.
+var globalThrottle *sftp.Throttle
+
+// dryRun lists the files a job would transfer without transferring them.
+var dryRun bool
+
 func main() {
     // Define flags
     customerName := flag.String("customer", "", "Customer name to run the SFTP job for")
     skipScheduler := flag.Bool("skip-scheduler", false, "Run only for the specified customer and skip the scheduler")
+    flag.BoolVar(&dryRun, "dry-run", false, "List the files the customer's job would transfer, without transferring them")
+    resetState := flag.Bool("reset-state", false, "Forget every file the customer's sync or download ledger has recorded, so the next run transfers them all again")
+    replay := flag.String("replay", "", "Forget the recorded files matching this glob or \"re:\" expression, so the next run transfers them again")
     flag.Parse()
 
     if *skipScheduler && *customerName == "" {
@@ -32,7 +43,21 @@ func main() {
         return
     }
 
-    if *skipScheduler {
+    if dryRun && *customerName == "" {
+        fmt.Println("Please specify a customer name when using the --dry-run flag")
+        return
+    }
+
+    if *resetState || *replay != "" {
+        if *customerName == "" {
+            fmt.Println("Please specify a customer name when using the --reset-state or --replay flag")
+            return
+        }
+        forgetTransfers(*customerName, *replay)
+        return
+    }
+
+    if *skipScheduler || dryRun {
         runSingleCustomer(*customerName)
     } else {
         runWithScheduler()
@@ -57,6 +82,10 @@ func runSingleCustomer(customerName string) {
     logStream := log.New(logFile, "", log.LstdFlags)
     logStream.Printf("Starting SFTP operation for %s", customerName)
 
+    if err := setGlobalThrottle("configs.json"); err != nil {
+        log.Fatalf("Error loading global bandwidth settings: %v", err)
+    }
+
     updateJobStatus(customerName, "Running")
     runSFTPJob(customerName, config, logStream)
     updateJobStatus(customerName, "Completed")
@@ -80,6 +109,10 @@ func runWithScheduler() {
     logStream := log.New(logFile, "", log.LstdFlags)
     logStream.Println("Starting SFTP service")
 
+    if err := setGlobalThrottle("appsettings.json"); err != nil {
+        log.Fatalf("Error loading global bandwidth settings: %v", err)
+    }
+
     // Create a new cron scheduler
     c := cron.New()
 
@@ -110,55 +143,190 @@ func runWithScheduler() {
 }
 
 func runSFTPJob(customerName string, config config.Configuration, logStream *log.Logger) {
-    // Decrypt the SFTP password
-    key := "mysecretencryptionkey" // Must be 32 bytes long for AES-256
-    sftpPassword, err := decrypt(config.SftpPassword, key)
+    if dryRun {
+        logStream = log.New(io.MultiWriter(logStream.Writer(), os.Stdout), logStream.Prefix(), logStream.Flags())
+    }
+
+    client, err := connect(customerName, config, logStream)
     if err != nil {
-        logStream.Printf("Failed to decrypt SFTP password for %s: %v", customerName, err)
+        logStream.Printf("Failed to connect to SFTP server for %s: %v", customerName, err)
         return
     }
+    defer client.Close()
+    logStream.Printf("Connected to SFTP server %s for %s", client.Address, customerName)
+    if !dryRun {
+        run := sftp.LastRun{Endpoint: client.Address, Started: time.Now()}
+        if err := sftp.SaveLastRun(config.LastRunFile(customerName), run); err != nil {
+            logStream.Printf("Error recording the endpoint for %s: %v", customerName, err)
+        }
+    }
 
-    // Convert SftpPort from string to int
-    sftpPort, err := strconv.Atoi(config.SftpPort)
+    throttle, err := sftp.NewThrottle(config.BandwidthLimitKBps, bandwidthWindows(config.BandwidthSchedule), globalThrottle)
     if err != nil {
-        logStream.Printf("Invalid SftpPort for %s: %v", customerName, err)
+        logStream.Printf("Invalid bandwidth settings for %s: %v", customerName, err)
         return
     }
 
-    client, err := sftp.NewSFTPClient(config.SftpUserName, sftpPassword, config.SftpServer, sftpPort)
+    workers := config.UploadWorkers
+    extensions := config.FileExtensions
+    if config.DownloadEnabled {
+        workers = config.DownloadWorkers
+        extensions = config.DownloadFileExtensions
+    }
+
+    markers := sftp.MarkerPolicy{
+        Source:      config.SourceMarkerSuffix,
+        Destination: config.DestinationMarkerSuffix,
+        Cleanup:     config.MarkerCleanup,
+    }
+
+    attributes, err := sftp.ParseFileAttributes(config.PreserveTimestamps, config.FileMode, config.DirMode, config.Ownership)
     if err != nil {
-        logStream.Printf("Failed to connect to SFTP server for %s: %v", customerName, err)
+        logStream.Printf("Invalid file attribute settings for %s: %v", customerName, err)
         return
     }
-    defer client.Close()
 
-    uploadedFiles := []string{}
-    downloadedFiles := []string{}
+    filter, err := sftp.NewFilter(extensions, config.IncludePatterns, config.ExcludePatterns, config.MinFileSizeBytes, config.MaxFileSizeBytes,
+        time.Duration(config.MinFileAgeMinutes)*time.Minute, time.Duration(config.MaxFileAgeMinutes)*time.Minute)
+    if err != nil {
+        logStream.Printf("Invalid file selection rules for %s: %v", customerName, err)
+        return
+    }
+
+    syncState, err := loadSyncState(customerName, config)
+    if err != nil {
+        logStream.Printf("Error loading sync state for %s: %v", customerName, err)
+        return
+    }
+    defer syncState.Unlock()
+
+    pool := openPool(customerName, config, client.Address, workers, logStream)
+    defer func() {
+        for _, extra := range pool {
+            extra.Close()
+        }
+    }()
 
     if config.DownloadEnabled {
-        err := sftp.DownloadDirectory(client, config.DownloadLocalPath, config.DownloadRemotePath, config.DownloadFileExtensions, logStream, &downloadedFiles, config.DownloadRootOnly, config.DeleteRemoteFileAfterDownload)
+        partSuffix := config.DownloadPartSuffix
+        if partSuffix == "" {
+            partSuffix = sftp.DefaultPartSuffix
+        }
+        staleHours := config.StalePartFileHours
+        if staleHours <= 0 {
+            staleHours = 24
+        }
+        if !dryRun {
+            err := sftp.CleanUpPartFiles(config.DownloadLocalPath, partSuffix, time.Duration(staleHours)*time.Hour, logStream)
+            if err != nil {
+                logStream.Printf("Error cleaning up partial downloads for %s: %v", customerName, err)
+            }
+        }
+
+        options := sftp.DownloadOptions{
+            Filter:              filter,
+            DryRun:              dryRun,
+            DownloadRootOnly:    config.DownloadRootOnly,
+            MaxDepth:            config.MaxDepth,
+            Flatten:             config.FlattenFolders,
+            DeleteAfterDownload: config.DeleteRemoteFileAfterDownload && syncState == nil,
+            PartSuffix:          partSuffix,
+            Markers:             markers,
+            Attributes:          attributes,
+            Checksums:           config.VerifyChecksums,
+            Workers:             config.DownloadWorkers,
+            Throttle:            throttle,
+            Pool:                pool,
+            Sync:                syncState,
+        }
+
+        results := &sftp.Results{}
+        err = sftp.DownloadDirectory(client, config.DownloadLocalPath, config.DownloadRemotePath, options, logStream, results)
         if err != nil {
             logStream.Printf("Error downloading files for %s: %v", customerName, err)
         }
+
+        failed := results.Failed()
+        logStream.Printf("Downloaded %d files for %s, %d failed", len(results.Succeeded()), customerName, len(failed))
+        for _, f := range failed {
+            logStream.Printf("Failed to download %s: %v", f.File, f.Err)
+        }
+        saveSyncState(customerName, syncState, results, logStream)
     } else {
-        err := sftp.UploadDirectory(client, config.LocalPath, config.RemotePath, config.TempRemotePath, config.FileExtensions, config.NewExtension, logStream, &uploadedFiles, config.UploadRootOnly, config.UseTempFolder)
+        onConflict, err := sftp.ParseConflictPolicy(config.OnConflict)
         if err != nil {
-            logStream.Printf("Error uploading files for %s: %v", customerName, err)
+            logStream.Printf("Invalid conflict policy for %s: %v", customerName, err)
+            return
+        }
+
+        stability := sftp.StabilityPolicy{
+            MinAge:     time.Duration(config.StableAfterSeconds) * time.Second,
+            Interval:   time.Duration(config.StabilityCheckSeconds) * time.Second,
+            CheckLocks: config.SkipFilesInUse,
+        }
+
+        options := sftp.UploadOptions{
+            TempRemotePath: config.TempRemotePath,
+            PartSuffix:     config.UploadPartSuffix,
+            NameTemplate:   config.RemoteNameTemplate,
+            Filter:         filter,
+            DryRun:         dryRun,
+            NewExtension:   config.NewExtension,
+            UploadRootOnly: config.UploadRootOnly,
+            MaxDepth:       config.MaxDepth,
+            Flatten:        config.FlattenFolders,
+            UseTempFolder:  config.UseTempFolder,
+            Resume:         config.ResumeUploads,
+            Stability:      stability,
+            Markers:        markers,
+            OnConflict:     onConflict,
+            Attributes:     attributes,
+            Checksums:      config.VerifyChecksums,
+            Workers:        config.UploadWorkers,
+            Throttle:       throttle,
+            Pool:           pool,
+            Sync:           syncState,
         }
 
-        err = moveFilesToArchive(config.ArchivePath, logStream, uploadedFiles)
+        results := &sftp.Results{}
+        err = sftp.UploadDirectory(client, config.LocalPath, config.RemotePath, options, logStream, results)
         if err != nil {
-            logStream.Printf("Error moving files to archive for %s: %v", customerName, err)
+            logStream.Printf("Error uploading files for %s: %v", customerName, err)
+        }
+
+        uploadedFiles := results.Succeeded()
+        failed := results.Failed()
+        conflicts := results.Conflicts()
+        logStream.Printf("Uploaded %d files for %s, %d failed, %d deferred, %d skipped, %d conflicts", len(uploadedFiles), customerName, len(failed), len(results.Deferred()), len(results.Skipped()), len(conflicts))
+        for _, f := range failed {
+            logStream.Printf("Failed to upload %s: %v", f.File, f.Err)
+        }
+        for _, c := range conflicts {
+            logStream.Printf("Conflict: %s -> %s %s", c.File, c.RemoteFile, c.Decision)
         }
+        saveSyncState(customerName, syncState, results, logStream)
 
-        if config.DeleteFoldersAfterArchive {
-            err = deleteArchivedFiles(logStream, uploadedFiles)
+        // A sync leaves the source files where they are.
+        if !dryRun && syncState == nil {
+            err = moveFilesToArchive(config.ArchivePath, logStream, uploadedFiles)
             if err != nil {
-                logStream.Printf("Error deleting archived files for %s: %v", customerName, err)
+                logStream.Printf("Error moving files to archive for %s: %v", customerName, err)
+            }
+
+            if config.DeleteFoldersAfterArchive {
+                err = deleteArchivedFiles(logStream, uploadedFiles)
+                if err != nil {
+                    logStream.Printf("Error deleting archived files for %s: %v", customerName, err)
+                }
             }
         }
     }
 
+    if dryRun {
+        logStream.Printf("Dry run for %s completed", customerName)
+        return
+    }
+
     err = sftp.CleanUpArchive(config.ArchivePath, config.CleanupThresholdDays, logStream)
     if err != nil {
         logStream.Printf("Error cleaning up archive for %s: %v", customerName, err)
@@ -167,6 +335,264 @@ func runSFTPJob(customerName string, config config.Configuration, logStream *log
     logStream.Printf("SFTP job for %s completed", customerName)
 }
 
+// loadSyncState returns the customer's sync state, or nil
+// when nothing is tracked. Outside sync mode only downloads that leave the
+// remote files in place keep one, as a ledger of the files already fetched.
+// Except on a dry run the state stays locked until it is unlocked, so it
+// cannot be changed under the job.
+func loadSyncState(customerName string, config config.Configuration) (*sftp.SyncState, error) {
+    switch config.TransferMode {
+    case "", "move":
+        if !config.TracksDownloads() {
+            return nil, nil
+        }
+    case "sync":
+    default:
+        return nil, fmt.Errorf("unknown TransferMode %q", config.TransferMode)
+    }
+
+    byHash := false
+    switch config.SyncCompare {
+    case "", "size-mtime":
+    case "hash":
+        byHash = true
+    default:
+        return nil, fmt.Errorf("unknown SyncCompare %q", config.SyncCompare)
+    }
+
+    load := sftp.LockSyncState
+    if dryRun {
+        load = sftp.LoadSyncState
+    }
+    state, err := load(config.StateFile(customerName))
+    if err != nil {
+        return nil, err
+    }
+    state.ByHash = byHash
+    state.PropagateDeletes = config.SyncDeletes && config.TransferMode == "sync"
+    return state, nil
+}
+
+// saveSyncState logs what was left alone or deleted because of the state
+// and keeps it for the next run. It does nothing without a state or on a
+// dry run.
+func saveSyncState(customerName string, state *sftp.SyncState, results *sftp.Results, logStream *log.Logger) {
+    if state == nil {
+        return
+    }
+    logStream.Printf("%d files for %s were already transferred, %d copies deleted", len(results.Unchanged()), customerName, len(results.Deleted()))
+    if dryRun {
+        return
+    }
+    if err := state.Save(); err != nil {
+        logStream.Printf("Error saving sync state for %s: %v", customerName, err)
+    }
+}
+
+// forgetTransfers drops the entries matching pattern, or all of them, from
+// the customer's sync state or download ledger, so that the next run
+// transfers those files again.
+func forgetTransfers(customerName, pattern string) {
+    config, err := config.LoadConfig(customerName)
+    if err != nil {
+        log.Fatalf("Error loading configuration: %v", err)
+    }
+    path := config.StateFile(customerName)
+
+    state, err := sftp.LockSyncState(path)
+    if err != nil {
+        log.Fatalf("Error reading %s: %v", path, err)
+    }
+    defer state.Unlock()
+    forgotten, err := state.Forget(pattern)
+    if err != nil {
+        log.Fatalf("Invalid pattern: %v", err)
+    }
+    if err := state.Save(); err != nil {
+        log.Fatalf("Error saving %s: %v", path, err)
+    }
+    for _, relPath := range forgotten {
+        fmt.Println(relPath)
+    }
+    fmt.Printf("Forgot %d files in %s; the next run for %s transfers them again\n", len(forgotten), path, customerName)
+}
+
+// connect logs in to the customer's SFTP server, trying each endpoint in
+// the order given by EndpointStrategy until one of them accepts. Round-robin
+// goes on from the endpoint recorded by the last run, so it rotates across
+// separate --skip-scheduler runs as well as inside the scheduler.
+func connect(customerName string, config config.Configuration, logStream *log.Logger) (*sftp.Client, error) {
+    lastRun, err := sftp.LoadLastRun(config.LastRunFile(customerName))
+    if err != nil {
+        logStream.Printf("Error reading last run of %s, starting at the first endpoint: %v", customerName, err)
+    }
+    endpoints := sftp.OrderEndpoints(config.Endpoints(), config.EndpointStrategy, lastRun.Endpoint)
+    return connectTo(customerName, config, endpoints, logStream)
+}
+
+// connectTo logs in to the first of endpoints that accepts, in order.
+func connectTo(customerName string, config config.Configuration, endpoints []string, logStream *log.Logger) (*sftp.Client, error) {
+    key := "mysecretencryptionkey" // Must be 32 bytes long for AES-256
+
+    jumpHosts := []sftp.Hop{}
+    for i, jumpHost := range config.JumpHosts {
+        hop, err := newHop(jumpHost, key, logStream)
+        if err != nil {
+            return nil, fmt.Errorf("invalid settings for jump host %d (%s): %w", i+1, jumpHost.SftpServer, err)
+        }
+        jumpHosts = append(jumpHosts, hop)
+        logStream.Printf("Connecting through jump host %s", hop.Address)
+    }
+
+    proxyPassword := ""
+    if config.ProxyPassword != "" {
+        var err error
+        proxyPassword, err = decrypt(config.ProxyPassword, key)
+        if err != nil {
+            return nil, fmt.Errorf("failed to decrypt proxy password: %w", err)
+        }
+    }
+    dialer, err := sftp.NewProxyDialer(config.Proxy, proxyPassword)
+    if err != nil {
+        return nil, fmt.Errorf("invalid proxy settings: %w", err)
+    }
+    if config.Proxy != "" {
+        logStream.Printf("Connecting through proxy %s", sftp.RedactProxyURL(config.Proxy))
+    }
+
+    timeouts := sftp.Timeouts{
+        Connect:            time.Duration(config.ConnectTimeoutSeconds) * time.Second,
+        Handshake:          time.Duration(config.HandshakeTimeoutSeconds) * time.Second,
+        KeepAlive:          time.Duration(config.KeepAliveIntervalSeconds) * time.Second,
+        KeepAliveMaxMissed: config.KeepAliveMaxMissed,
+    }
+    throughput := sftp.Throughput{
+        MaxPacketSize:                config.MaxPacketSize,
+        MaxConcurrentRequestsPerFile: config.MaxConcurrentRequestsPerFile,
+        DisableConcurrentReads:       config.DisableConcurrentReads,
+        UseConcurrentWrites:          config.UseConcurrentWrites,
+    }
+    retryPolicy := sftp.RetryPolicy{
+        MaxAttempts:    config.RetryMaxAttempts,
+        InitialBackoff: time.Duration(config.RetryInitialBackoffSeconds) * time.Second,
+        MaxBackoff:     time.Duration(config.RetryMaxBackoffSeconds) * time.Second,
+        Jitter:         config.RetryJitter,
+    }
+
+    for i, endpoint := range endpoints {
+        host := config.Target()
+        host.SftpServer, host.SftpPort, err = net.SplitHostPort(endpoint)
+        if err != nil {
+            return nil, fmt.Errorf("invalid endpoint %s: %w", endpoint, err)
+        }
+        target, err := newHop(host, key, logStream)
+        if err != nil {
+            return nil, fmt.Errorf("invalid connection settings: %w", err)
+        }
+
+        client, err := sftp.ConnectWithRetry(retryPolicy, target.Address, logStream, func() (*sftp.Client, error) {
+            return sftp.NewSFTPClient(dialer, target, jumpHosts, timeouts, throughput, logStream)
+        })
+        if err == nil {
+            return client, nil
+        }
+        if i == len(endpoints)-1 {
+            return nil, err
+        }
+        logStream.Printf("Endpoint %s failed for %s, failing over to %s: %v", endpoint, customerName, endpoints[i+1], err)
+    }
+    return nil, errors.New("no endpoints configured")
+}
+
+// openPool opens the extra SFTP connections the transfer workers share, up
+// to TransferConnections in total but never more than there are workers.
+// They all go to address, the endpoint serving the run, so that one run's
+// files do not end up on different servers.
+func openPool(customerName string, config config.Configuration, address string, workers int, logStream *log.Logger) []*sftp.Client {
+    pool := []*sftp.Client{}
+    for i := 1; i < config.TransferConnections && i < workers; i++ {
+        extra, err := connectTo(customerName, config, []string{address}, logStream)
+        if err != nil {
+            logStream.Printf("Failed to open extra SFTP connection for %s, continuing with %d: %v", customerName, i, err)
+            break
+        }
+        pool = append(pool, extra)
+    }
+    return pool
+}
+
+// newHop decrypts the secrets of host and builds the SSH settings used to
+// log in to it.
+func newHop(host config.SSHHost, key string, logStream *log.Logger) (sftp.Hop, error) {
+    // Decrypt the SFTP password, private key passphrase and prompt answers
+    credentials := sftp.Credentials{PrivateKeyPath: host.PrivateKeyPath, CertificatePath: host.CertificatePath}
+    var err error
+    if host.SftpPassword != "" {
+        credentials.Password, err = decrypt(host.SftpPassword, key)
+        if err != nil {
+            return sftp.Hop{}, fmt.Errorf("failed to decrypt SFTP password: %w", err)
+        }
+    }
+    if host.PrivateKeyPassphrase != "" {
+        credentials.PrivateKeyPassphrase, err = decrypt(host.PrivateKeyPassphrase, key)
+        if err != nil {
+            return sftp.Hop{}, fmt.Errorf("failed to decrypt private key passphrase: %w", err)
+        }
+    }
+    if len(host.KeyboardInteractiveAnswers) > 0 {
+        credentials.KeyboardInteractiveAnswers = make(map[string]string)
+        for prompt, encryptedAnswer := range host.KeyboardInteractiveAnswers {
+            credentials.KeyboardInteractiveAnswers[prompt], err = decrypt(encryptedAnswer, key)
+            if err != nil {
+                return sftp.Hop{}, fmt.Errorf("failed to decrypt keyboard-interactive answer for prompt %q: %w", prompt, err)
+            }
+        }
+    }
+
+    auth, err := sftp.NewAuthMethods(host.AuthMethods, credentials)
+    if err != nil {
+        return sftp.Hop{}, fmt.Errorf("invalid authentication settings: %w", err)
+    }
+
+    // Convert SftpPort from string to int
+    sftpPort, err := strconv.Atoi(host.SftpPort)
+    if err != nil {
+        return sftp.Hop{}, fmt.Errorf("invalid SftpPort: %w", err)
+    }
+
+    hostKeyCallback, err := sftp.NewHostKeyCallback(host.KnownHostsFile, host.HostKeyFingerprints, host.TrustOnFirstUse, logStream)
+    if err != nil {
+        return sftp.Hop{}, fmt.Errorf("invalid host key settings: %w", err)
+    }
+
+    algorithms := sftp.ParseAlgorithms(host.Ciphers, host.KeyExchanges, host.MACs, host.HostKeyAlgorithms)
+    if len(algorithms.HostKeyAlgorithms) == 0 && host.KnownHostsFile != "" {
+        // Ask for a key type known_hosts holds, not the ssh package's favourite.
+        algorithms.HostKeyAlgorithms = sftp.KnownHostKeyAlgorithms(host.KnownHostsFile, net.JoinHostPort(host.SftpServer, host.SftpPort))
+    }
+
+    return sftp.NewHop(host.SftpUserName, auth, host.SftpServer, sftpPort, hostKeyCallback, algorithms), nil
+}
+
+// setGlobalThrottle applies the bandwidth cap shared by all customers, set
+// in the defaults entry of the configuration file.
+func setGlobalThrottle(filePath string) error {
+    defaults, err := config.LoadDefaults(filePath)
+    if err != nil {
+        return err
+    }
+    globalThrottle, err = sftp.NewThrottle(defaults.GlobalBandwidthLimitKBps, bandwidthWindows(defaults.GlobalBandwidthSchedule), nil)
+    return err
+}
+
+func bandwidthWindows(schedule []config.BandwidthWindow) []sftp.BandwidthWindow {
+    windows := []sftp.BandwidthWindow{}
+    for _, w := range schedule {
+        windows = append(windows, sftp.BandwidthWindow{Start: w.Start, End: w.End, LimitKBps: w.LimitKBps})
+    }
+    return windows
+}
+
 func moveFilesToArchive(archivePath string, logStream *log.Logger, uploadedFiles []string) error {
     archivePathWithDate := filepath.Join(archivePath, time.Now().Format("2006-01-02"))
 
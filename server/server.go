@@ -2,16 +2,19 @@ package main
 
 import (
     "encoding/json"
+    "errors"
     "io"
     "log"
     "net/http"
     "os"
     "path/filepath"
+    "strings"
     "sync"
     "time"
 
     "github.com/robfig/cron/v3"
     "sftphive/config"
+    "sftphive/sftp"
 )
 
 var (
@@ -65,6 +68,7 @@ func main() {
     http.HandleFunc("/logs", logsHandler)
     http.HandleFunc("/status", statusHandler)
     http.HandleFunc("/logfile", logFileHandler)
+    http.HandleFunc("/state", stateHandler)
     http.Handle("/", http.FileServer(http.Dir("./static")))
 
     log.Println("Starting web server on :8080")
@@ -138,15 +142,71 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
     defer mu.Unlock()
     status := make(map[string]map[string]string)
     for customerName, jobStatus := range jobStatuses {
+        // Written by the job, from the endpoint it actually logged in to.
+        lastRun, err := sftp.LoadLastRun(configs[customerName].LastRunFile(customerName))
+        if err != nil {
+            log.Printf("Error reading last run of %s: %v", customerName, err)
+        }
         status[customerName] = map[string]string{
-            "status":  jobStatus,
-            "nextRun": jobSchedules[customerName].Format(time.RFC3339),
+            "status":   jobStatus,
+            "nextRun":  jobSchedules[customerName].Format(time.RFC3339),
+            "endpoint": lastRun.Endpoint,
         }
     }
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(status)
 }
 
+// stateHandler shows a customer's sync state or download ledger on GET.
+// On POST it forgets the files matching the "pattern" parameter, or all of
+// them, so the customer's next run transfers them again.
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+    customerName := r.URL.Query().Get("customer")
+    customerConfig, ok := configs[customerName]
+    if !ok {
+        http.Error(w, "Unknown customer", http.StatusNotFound)
+        return
+    }
+    path := customerConfig.StateFile(customerName)
+
+    switch r.Method {
+    case http.MethodGet:
+        state, err := sftp.LoadSyncState(path)
+        if err != nil {
+            http.Error(w, "Could not read state file", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(state.Files())
+    case http.MethodPost:
+        // A running job holds the lock, and would write its own copy of the
+        // state back over ours.
+        state, err := sftp.LockSyncState(path)
+        if errors.Is(err, sftp.ErrStateLocked) {
+            http.Error(w, "Job is running", http.StatusConflict)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Could not read state file", http.StatusInternalServerError)
+            return
+        }
+        defer state.Unlock()
+        forgotten, err := state.Forget(r.URL.Query().Get("pattern"))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err := state.Save(); err != nil {
+            http.Error(w, "Could not save state file", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string][]string{"forgotten": forgotten})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
 func runSFTPJob(customerName string, config config.Configuration) {
     logFilePath := "logs/" + customerName + ".log"
     logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
@@ -159,6 +219,6 @@ func runSFTPJob(customerName string, config config.Configuration) {
 
     logStream.Printf("Starting SFTP operation for %s\n", customerName)
     logStream.Printf("Running scheduled job for %s\n", customerName)
-    logStream.Printf("Connected to SFTP server %s:%s\n", config.SftpServer, config.SftpPort)
+    logStream.Printf("SFTP endpoints for %s: %s\n", customerName, strings.Join(config.Endpoints(), ", "))
     logStream.Printf("SFTP job for %s completed\n", customerName)
 }
@@ -0,0 +1,235 @@
+package sftp
+
+import (
+    "bytes"
+    "encoding/binary"
+    "log"
+    "net"
+    "strings"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// Algorithms restricts the SSH algorithms offered to a server. An empty list
+// keeps the ssh package defaults.
+type Algorithms struct {
+    Ciphers           []string
+    KeyExchanges      []string
+    MACs              []string
+    HostKeyAlgorithms []string
+}
+
+// weakAlgorithms are still accepted when configured, for legacy partners,
+// but negotiating one of them is logged as a warning.
+var weakAlgorithms = map[string]bool{
+    "diffie-hellman-group1-sha1":         true,
+    "diffie-hellman-group14-sha1":        true,
+    "diffie-hellman-group-exchange-sha1": true,
+    "aes128-cbc":                         true,
+    "3des-cbc":                           true,
+    "arcfour":                            true,
+    "arcfour128":                         true,
+    "arcfour256":                         true,
+    "hmac-sha1":                          true,
+    "hmac-sha1-96":                       true,
+    ssh.KeyAlgoRSA:                       true,
+    ssh.KeyAlgoDSA:                       true,
+    ssh.CertAlgoRSAv01:                   true,
+    ssh.CertAlgoDSAv01:                   true,
+}
+
+// defaultHostKeyAlgorithms mirrors the ssh package's client preference
+// order, which it does not export.
+var defaultHostKeyAlgorithms = []string{
+    ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+    ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+    ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+    ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+    ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+    ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+    ssh.KeyAlgoED25519,
+}
+
+// ParseAlgorithms builds an Algorithms policy from comma-separated lists.
+func ParseAlgorithms(ciphers, keyExchanges, macs, hostKeyAlgorithms string) Algorithms {
+    return Algorithms{
+        Ciphers:           splitList(ciphers),
+        KeyExchanges:      splitList(keyExchanges),
+        MACs:              splitList(macs),
+        HostKeyAlgorithms: splitList(hostKeyAlgorithms),
+    }
+}
+
+func (a Algorithms) apply(config *ssh.ClientConfig) {
+    config.Ciphers = a.Ciphers
+    config.KeyExchanges = a.KeyExchanges
+    config.MACs = a.MACs
+    config.HostKeyAlgorithms = a.HostKeyAlgorithms
+}
+
+func splitList(list string) []string {
+    var items []string
+    for _, item := range strings.Split(list, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// negotiated works out the algorithms picked for a connection the same way
+// both sides do (RFC 4253 7.1: the first client algorithm the server also
+// supports), from the client config and the server's KEXINIT.
+func negotiated(config *ssh.ClientConfig, server *kexInit) map[string]string {
+    clientConfig := config.Config
+    clientConfig.SetDefaults()
+    hostKeyAlgorithms := config.HostKeyAlgorithms
+    if len(hostKeyAlgorithms) == 0 {
+        hostKeyAlgorithms = defaultHostKeyAlgorithms
+    }
+
+    result := map[string]string{
+        "key exchange":      firstCommon(clientConfig.KeyExchanges, server.kexAlgos),
+        "host key":          firstCommon(hostKeyAlgorithms, server.hostKeyAlgos),
+        "cipher (outgoing)": firstCommon(clientConfig.Ciphers, server.ciphersClientServer),
+        "cipher (incoming)": firstCommon(clientConfig.Ciphers, server.ciphersServerClient),
+    }
+    // AEAD ciphers carry their own integrity check and ignore the MAC.
+    if !isAEAD(result["cipher (outgoing)"]) {
+        result["MAC (outgoing)"] = firstCommon(clientConfig.MACs, server.macsClientServer)
+    }
+    if !isAEAD(result["cipher (incoming)"]) {
+        result["MAC (incoming)"] = firstCommon(clientConfig.MACs, server.macsServerClient)
+    }
+    return result
+}
+
+func firstCommon(client, server []string) string {
+    for _, c := range client {
+        for _, s := range server {
+            if c == s {
+                return c
+            }
+        }
+    }
+    return ""
+}
+
+func isAEAD(cipher string) bool {
+    return strings.HasSuffix(cipher, "-gcm@openssh.com") || cipher == "chacha20-poly1305@openssh.com"
+}
+
+// warnWeakAlgorithms logs a warning for each weak algorithm negotiated with
+// the server at address.
+func warnWeakAlgorithms(address string, config *ssh.ClientConfig, conn *kexInitConn, logStream *log.Logger) {
+    if conn.serverKexInit == nil {
+        return
+    }
+    algorithms := negotiated(config, conn.serverKexInit)
+    for _, use := range []string{"key exchange", "host key", "cipher (outgoing)", "cipher (incoming)", "MAC (outgoing)", "MAC (incoming)"} {
+        if algorithm := algorithms[use]; weakAlgorithms[algorithm] {
+            logStream.Printf("WARNING: weak %s algorithm %s negotiated with %s", use, algorithm, address)
+        }
+    }
+}
+
+// kexInit holds the name-lists of an SSH_MSG_KEXINIT packet.
+type kexInit struct {
+    kexAlgos            []string
+    hostKeyAlgos        []string
+    ciphersClientServer []string
+    ciphersServerClient []string
+    macsClientServer    []string
+    macsServerClient    []string
+}
+
+// kexInitConn watches the start of the server's stream for its first
+// KEXINIT, which is sent in the clear, so the negotiated algorithms can be
+// reported; the ssh package does not expose them.
+type kexInitConn struct {
+    net.Conn
+    buf           []byte
+    done          bool
+    serverKexInit *kexInit
+}
+
+const msgKexInit = 20
+
+func (c *kexInitConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    if !c.done && n > 0 {
+        c.buf = append(c.buf, p[:n]...)
+        c.parse()
+    }
+    return n, err
+}
+
+func (c *kexInitConn) parse() {
+    // Skip the version line, and any lines the server sends before it.
+    data := c.buf
+    for {
+        line := bytes.IndexByte(data, '\n')
+        if line < 0 {
+            c.giveUpIfLarge()
+            return
+        }
+        isVersion := bytes.HasPrefix(data, []byte("SSH-"))
+        data = data[line+1:]
+        if isVersion {
+            break
+        }
+    }
+
+    if len(data) < 5 {
+        return
+    }
+    packetLength := binary.BigEndian.Uint32(data)
+    if packetLength > 256*1024 {
+        c.done = true
+        return
+    }
+    if uint32(len(data)-4) < packetLength {
+        c.giveUpIfLarge()
+        return
+    }
+
+    c.done = true
+    c.buf = nil
+    paddingLength := uint32(data[4])
+    if paddingLength+1 > packetLength {
+        return
+    }
+    payload := data[5 : 4+packetLength-paddingLength]
+    if len(payload) < 17 || payload[0] != msgKexInit {
+        return
+    }
+
+    payload = payload[17:] // message type and cookie
+    lists := make([][]string, 6)
+    for i := range lists {
+        if len(payload) < 4 {
+            return
+        }
+        length := binary.BigEndian.Uint32(payload)
+        if uint32(len(payload)-4) < length {
+            return
+        }
+        lists[i] = splitList(string(payload[4 : 4+length]))
+        payload = payload[4+length:]
+    }
+    c.serverKexInit = &kexInit{
+        kexAlgos:            lists[0],
+        hostKeyAlgos:        lists[1],
+        ciphersClientServer: lists[2],
+        ciphersServerClient: lists[3],
+        macsClientServer:    lists[4],
+        macsServerClient:    lists[5],
+    }
+}
+
+func (c *kexInitConn) giveUpIfLarge() {
+    if len(c.buf) > 512*1024 {
+        c.done = true
+        c.buf = nil
+    }
+}
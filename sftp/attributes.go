@@ -0,0 +1,166 @@
+package sftp
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/pkg/sftp"
+)
+
+// FileAttributes are the times, modes and owner transferred files are given.
+type FileAttributes struct {
+    PreserveTimes bool        // Give each copy the source's modification time
+    FileMode      os.FileMode // Mode of transferred files, 0 for the default
+    DirMode       os.FileMode // Mode of folders created for them, 0 for the default
+    UID, GID      int         // Owner of transferred files, -1 to leave it
+}
+
+// ParseFileAttributes reads modes as octal strings such as "0640" and
+// ownership as "uid:gid". Empty strings leave the defaults.
+func ParseFileAttributes(preserveTimes bool, fileMode, dirMode, ownership string) (FileAttributes, error) {
+    a := FileAttributes{PreserveTimes: preserveTimes, UID: -1, GID: -1}
+
+    var err error
+    if a.FileMode, err = parseMode(fileMode); err != nil {
+        return a, err
+    }
+    if a.DirMode, err = parseMode(dirMode); err != nil {
+        return a, err
+    }
+
+    if ownership = strings.TrimSpace(ownership); ownership != "" {
+        uid, gid, ok := strings.Cut(ownership, ":")
+        if !ok {
+            return a, fmt.Errorf("invalid ownership %q, expected uid:gid", ownership)
+        }
+        if a.UID, err = strconv.Atoi(uid); err != nil {
+            return a, fmt.Errorf("invalid ownership %q, expected uid:gid", ownership)
+        }
+        if a.GID, err = strconv.Atoi(gid); err != nil {
+            return a, fmt.Errorf("invalid ownership %q, expected uid:gid", ownership)
+        }
+    }
+    return a, nil
+}
+
+func parseMode(mode string) (os.FileMode, error) {
+    if mode = strings.TrimSpace(mode); mode == "" {
+        return 0, nil
+    }
+    m, err := strconv.ParseUint(mode, 8, 32)
+    if err != nil || m > 0777 {
+        return 0, fmt.Errorf("invalid mode %q, expected octal such as 0644", mode)
+    }
+    return os.FileMode(m), nil
+}
+
+// applyRemote sets the attributes on an uploaded file, before it is moved
+// to its final name so that it appears there with them. Where the local
+// access time is not available it is set to the modification time.
+// Servers may refuse ownership changes; that is logged and ignored.
+func (a FileAttributes) applyRemote(client *Client, remoteFile string, source os.FileInfo, logStream *log.Logger) error {
+    if a.PreserveTimes {
+        if err := client.Chtimes(remoteFile, accessTime(source), source.ModTime()); err != nil {
+            return err
+        }
+    }
+    if a.FileMode != 0 {
+        if err := client.Chmod(remoteFile, a.FileMode); err != nil {
+            return err
+        }
+    }
+    if a.UID >= 0 {
+        if err := client.Chown(remoteFile, a.UID, a.GID); err != nil {
+            logStream.Printf("Could not change owner of %s to %d:%d: %v", remoteFile, a.UID, a.GID, err)
+        }
+    }
+    return nil
+}
+
+// applyLocal sets the attributes on a downloaded part file, before it is
+// renamed like applyRemote, taking the access time from the server where
+// it reports one.
+func (a FileAttributes) applyLocal(localFile string, source os.FileInfo, logStream *log.Logger) error {
+    if a.PreserveTimes {
+        atime := source.ModTime()
+        if stat, ok := source.Sys().(*sftp.FileStat); ok && stat.Atime != 0 {
+            atime = time.Unix(int64(stat.Atime), 0)
+        }
+        if err := os.Chtimes(localFile, atime, source.ModTime()); err != nil {
+            return err
+        }
+    }
+    if a.FileMode != 0 {
+        if err := os.Chmod(localFile, a.FileMode); err != nil {
+            return err
+        }
+    }
+    if a.UID >= 0 {
+        if err := os.Chown(localFile, a.UID, a.GID); err != nil {
+            logStream.Printf("Could not change owner of %s to %d:%d: %v", localFile, a.UID, a.GID, err)
+        }
+    }
+    return nil
+}
+
+// folders are the calls mkdir makes, on the server or the local disk.
+type folders struct {
+    stat     func(dir string) (os.FileInfo, error)
+    mkdir    func(dir string, mode os.FileMode) error
+    mkdirAll func(dir string) error // With the default mode
+    chmod    func(dir string, mode os.FileMode) error
+}
+
+// mkdir creates dir and any missing parents, giving the folders it creates
+// DirMode when that is set.
+func (a FileAttributes) mkdir(f folders, dir string) error {
+    if a.DirMode == 0 {
+        return f.mkdirAll(dir)
+    }
+    if info, err := f.stat(dir); err == nil {
+        if !info.IsDir() {
+            return fmt.Errorf("%s exists and is not a folder", dir)
+        }
+        return nil
+    }
+    if parent := filepath.Dir(dir); parent != dir {
+        if err := a.mkdir(f, parent); err != nil {
+            return err
+        }
+    }
+    if err := f.mkdir(dir, a.DirMode); err != nil {
+        // Another worker may have just created it.
+        if info, statErr := f.stat(dir); statErr == nil && info.IsDir() {
+            return nil
+        }
+        return err
+    }
+    // A local mode is reduced by the umask, and the server picks its own.
+    return f.chmod(dir, a.DirMode)
+}
+
+// mkdirRemote creates dir and any missing parents on the server.
+func (a FileAttributes) mkdirRemote(client *Client, dir string) error {
+    return a.mkdir(folders{
+        stat:     client.Stat,
+        mkdir:    func(dir string, _ os.FileMode) error { return client.Mkdir(dir) },
+        mkdirAll: client.MkdirAll,
+        chmod:    client.Chmod,
+    }, dir)
+}
+
+// mkdirLocal creates dir and any missing parents, with 0755 when DirMode is
+// not set.
+func (a FileAttributes) mkdirLocal(dir string) error {
+    return a.mkdir(folders{
+        stat:     os.Stat,
+        mkdir:    os.Mkdir,
+        mkdirAll: func(dir string) error { return os.MkdirAll(dir, 0755) },
+        chmod:    os.Chmod,
+    }, dir)
+}
@@ -0,0 +1,18 @@
+//go:build darwin || freebsd || netbsd
+
+package sftp
+
+import (
+    "os"
+    "syscall"
+    "time"
+)
+
+// accessTime returns when a local file was last read, or its modification
+// time if the access time is not known.
+func accessTime(info os.FileInfo) time.Time {
+    if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+        return time.Unix(stat.Atimespec.Unix())
+    }
+    return info.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !openbsd && !dragonfly && !solaris && !darwin && !freebsd && !netbsd
+
+package sftp
+
+import (
+    "os"
+    "time"
+)
+
+// accessTime returns the modification time where the access time of a
+// local file is not available.
+func accessTime(info os.FileInfo) time.Time {
+    return info.ModTime()
+}
@@ -0,0 +1,283 @@
+package sftp
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
+)
+
+// Credentials holds the decrypted secrets a customer logs in with.
+type Credentials struct {
+    Password             string
+    PrivateKeyPath       string
+    PrivateKeyPassphrase string
+    CertificatePath      string
+    // KeyboardInteractiveAnswers maps a prompt (matched case-insensitively
+    // as a substring, e.g. "verification code") to its answer.
+    KeyboardInteractiveAnswers map[string]string
+}
+
+// NewAuthMethods returns the ssh auth methods listed in authMethods
+// (comma-separated, tried in order). Supported methods are "publickey",
+// "agent", "password" and "keyboard-interactive". When authMethods is empty,
+// publickey is used if a private key is configured, followed by password.
+//
+// publickey and agent are both SSH public key authentication, so their keys
+// are offered together, in the listed order, at the position of the first one.
+// Servers that require several methods (AuthenticationMethods
+// publickey,password) accept a partial login after each one, so listing all
+// of them in AuthMethods is enough to chain them.
+func NewAuthMethods(authMethods string, credentials Credentials) ([]ssh.AuthMethod, error) {
+    methods := []string{}
+    for _, method := range strings.Split(authMethods, ",") {
+        if method = strings.ToLower(strings.TrimSpace(method)); method != "" {
+            methods = append(methods, method)
+        }
+    }
+    if len(methods) == 0 {
+        if credentials.PrivateKeyPath != "" {
+            methods = append(methods, "publickey")
+        }
+        if credentials.Password != "" || len(methods) == 0 {
+            methods = append(methods, "password")
+        }
+    }
+
+    auth := []ssh.AuthMethod{}
+    signerSources := []func() ([]ssh.Signer, error){}
+    for _, method := range methods {
+        switch method {
+        case "publickey":
+            signers, err := loadKeyFileSigners(credentials)
+            if err != nil {
+                return nil, err
+            }
+            signerSources = append(signerSources, func() ([]ssh.Signer, error) { return signers, nil })
+        case "agent":
+            socket := os.Getenv("SSH_AUTH_SOCK")
+            if socket == "" {
+                return nil, errors.New("agent auth requires SSH_AUTH_SOCK")
+            }
+            certificatePath := credentials.CertificatePath
+            signerSources = append(signerSources, func() ([]ssh.Signer, error) { return loadAgentSigners(socket, certificatePath) })
+        case "password":
+            auth = append(auth, ssh.Password(credentials.Password))
+            continue
+        case "keyboard-interactive":
+            auth = append(auth, ssh.KeyboardInteractive(keyboardInteractiveChallenge(credentials)))
+            continue
+        default:
+            return nil, fmt.Errorf("unsupported auth method %q", method)
+        }
+
+        if len(signerSources) == 1 {
+            auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+                all := []ssh.Signer{}
+                for _, source := range signerSources {
+                    signers, err := source()
+                    if err != nil {
+                        return nil, err
+                    }
+                    all = append(all, signers...)
+                }
+                return all, nil
+            }))
+        }
+    }
+    return auth, nil
+}
+
+// keyboardInteractiveChallenge answers each prompt from
+// KeyboardInteractiveAnswers, falling back to the password for prompts that
+// ask for one. When several entries match a prompt the longest one wins, so
+// "one-time password" beats "password" for "One-time password:".
+func keyboardInteractiveChallenge(credentials Credentials) ssh.KeyboardInteractiveChallenge {
+    return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+        answers := make([]string, len(questions))
+        for i, question := range questions {
+            prompt := strings.ToLower(question)
+            answered := false
+            best := ""
+            for match, answer := range credentials.KeyboardInteractiveAnswers {
+                if !strings.Contains(prompt, strings.ToLower(match)) {
+                    continue
+                }
+                // Ties go to the first in sort order, not map order.
+                if !answered || len(match) > len(best) || (len(match) == len(best) && match < best) {
+                    answers[i] = answer
+                    answered = true
+                    best = match
+                }
+            }
+            if !answered && strings.Contains(prompt, "password") && credentials.Password != "" {
+                answers[i] = credentials.Password
+                answered = true
+            }
+            if !answered {
+                return nil, fmt.Errorf("no KeyboardInteractiveAnswers entry for prompt %q", strings.TrimSpace(question))
+            }
+        }
+        return answers, nil
+    }
+}
+
+// loadKeyFileSigners returns the signer for PrivateKeyPath, preceded by its
+// certificate signer when CertificatePath is set.
+func loadKeyFileSigners(credentials Credentials) ([]ssh.Signer, error) {
+    signer, err := loadPrivateKey(credentials.PrivateKeyPath, credentials.PrivateKeyPassphrase)
+    if err != nil {
+        return nil, err
+    }
+    if credentials.CertificatePath == "" {
+        return []ssh.Signer{signer}, nil
+    }
+
+    cert, err := loadCertificate(credentials.CertificatePath)
+    if err != nil {
+        return nil, err
+    }
+    certSigner, err := ssh.NewCertSigner(cert, signer)
+    if err != nil {
+        return nil, fmt.Errorf("certificate %s does not match %s: %w", credentials.CertificatePath, credentials.PrivateKeyPath, err)
+    }
+    return []ssh.Signer{certSigner, signer}, nil
+}
+
+// loadPrivateKey reads an RSA, ECDSA or Ed25519 private key in PEM or
+// OpenSSH format, decrypting it with passphrase when one is given.
+func loadPrivateKey(privateKeyPath, passphrase string) (ssh.Signer, error) {
+    if privateKeyPath == "" {
+        return nil, fmt.Errorf("publickey auth requires PrivateKeyPath")
+    }
+
+    pemBytes, err := os.ReadFile(privateKeyPath)
+    if err != nil {
+        return nil, err
+    }
+
+    var signer ssh.Signer
+    if passphrase != "" {
+        signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+    } else {
+        signer, err = ssh.ParsePrivateKey(pemBytes)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("parsing private key %s: %w", privateKeyPath, err)
+    }
+    return signer, nil
+}
+
+// loadCertificate reads an OpenSSH user certificate (the "-cert.pub" file
+// written by ssh-keygen -s) and checks that it is currently valid.
+func loadCertificate(certificatePath string) (*ssh.Certificate, error) {
+    certBytes, err := os.ReadFile(certificatePath)
+    if err != nil {
+        return nil, err
+    }
+
+    pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+    if err != nil {
+        return nil, fmt.Errorf("parsing certificate %s: %w", certificatePath, err)
+    }
+    cert, ok := pub.(*ssh.Certificate)
+    if !ok {
+        return nil, fmt.Errorf("%s is not an OpenSSH certificate", certificatePath)
+    }
+    if cert.CertType != ssh.UserCert {
+        return nil, fmt.Errorf("%s is not a user certificate", certificatePath)
+    }
+
+    now := uint64(time.Now().Unix())
+    if cert.ValidAfter != 0 && now < cert.ValidAfter {
+        return nil, fmt.Errorf("certificate %s is not valid before %s", certificatePath, time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339))
+    }
+    if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+        return nil, fmt.Errorf("certificate %s expired at %s", certificatePath, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+    }
+    return cert, nil
+}
+
+// loadAgentSigners lists the keys (and certificates) held by the ssh-agent
+// on socket. When certificatePath is set, the certificate is also offered
+// for the agent key it was issued for.
+func loadAgentSigners(socket, certificatePath string) ([]ssh.Signer, error) {
+    keys, err := withAgent(socket, func(client agent.ExtendedAgent) ([]*agent.Key, error) {
+        return client.List()
+    })
+    if err != nil {
+        return nil, fmt.Errorf("listing ssh-agent keys: %w", err)
+    }
+
+    var cert *ssh.Certificate
+    if certificatePath != "" {
+        if cert, err = loadCertificate(certificatePath); err != nil {
+            return nil, err
+        }
+    }
+
+    signers := []ssh.Signer{}
+    for _, key := range keys {
+        pub, err := ssh.ParsePublicKey(key.Blob)
+        if err != nil {
+            return nil, err
+        }
+        signer := &agentSigner{socket: socket, pub: pub}
+        if cert != nil && string(cert.Key.Marshal()) == string(pub.Marshal()) {
+            certSigner, err := ssh.NewCertSigner(cert, signer)
+            if err != nil {
+                return nil, err
+            }
+            signers = append(signers, certSigner)
+        }
+        signers = append(signers, signer)
+    }
+    if cert != nil && len(signers) == len(keys) {
+        return nil, fmt.Errorf("no ssh-agent key matches certificate %s", certificatePath)
+    }
+    return signers, nil
+}
+
+// agentSigner signs with a key held by the ssh-agent, opening a connection
+// to the agent for each signature so no socket is left open after login.
+type agentSigner struct {
+    socket string
+    pub    ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+    return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+    return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+    var flags agent.SignatureFlags
+    switch algorithm {
+    case ssh.KeyAlgoRSASHA256:
+        flags = agent.SignatureFlagRsaSha256
+    case ssh.KeyAlgoRSASHA512:
+        flags = agent.SignatureFlagRsaSha512
+    }
+    return withAgent(s.socket, func(client agent.ExtendedAgent) (*ssh.Signature, error) {
+        return client.SignWithFlags(s.pub, data, flags)
+    })
+}
+
+func withAgent[T any](socket string, fn func(agent.ExtendedAgent) (T, error)) (T, error) {
+    conn, err := net.Dial("unix", socket)
+    if err != nil {
+        var zero T
+        return zero, err
+    }
+    defer conn.Close()
+    return fn(agent.NewClient(conn))
+}
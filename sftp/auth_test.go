@@ -0,0 +1,315 @@
+package sftp
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
+)
+
+// testKeys are a user key, the same key certified by a CA, and files for
+// both as a customer would configure them.
+type testKeys struct {
+    private         ed25519.PrivateKey
+    public          ssh.PublicKey
+    ca              ssh.PublicKey
+    privateKeyPath  string
+    certificatePath string
+}
+
+func newTestKeys(t *testing.T) testKeys {
+    t.Helper()
+    dir := t.TempDir()
+
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signer, err := ssh.NewSignerFromKey(private)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKCS8PrivateKey(private)
+    if err != nil {
+        t.Fatal(err)
+    }
+    privateKeyPath := filepath.Join(dir, "id_ed25519")
+    if err := os.WriteFile(privateKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    _, caKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    caSigner, err := ssh.NewSignerFromKey(caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert := &ssh.Certificate{
+        Key:             signer.PublicKey(),
+        CertType:        ssh.UserCert,
+        ValidPrincipals: []string{"test"},
+        ValidBefore:     ssh.CertTimeInfinity,
+    }
+    if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+        t.Fatal(err)
+    }
+    certificatePath := privateKeyPath + "-cert.pub"
+    if err := os.WriteFile(certificatePath, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    return testKeys{
+        private:         private,
+        public:          signer.PublicKey(),
+        ca:              caSigner.PublicKey(),
+        privateKeyPath:  privateKeyPath,
+        certificatePath: certificatePath,
+    }
+}
+
+// startTestAgent serves an ssh-agent holding key and points SSH_AUTH_SOCK
+// at it for the rest of the test.
+func startTestAgent(t *testing.T, key ed25519.PrivateKey) {
+    t.Helper()
+    keyring := agent.NewKeyring()
+    if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+        t.Fatal(err)
+    }
+    socket := filepath.Join(t.TempDir(), "agent.sock")
+    listener, err := net.Listen("unix", socket)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                agent.ServeAgent(keyring, conn)
+                conn.Close()
+            }()
+        }
+    }()
+    t.Setenv("SSH_AUTH_SOCK", socket)
+}
+
+// testLogin is what the test server accepts.
+type testLogin struct {
+    password    string
+    key         ssh.PublicKey
+    ca          ssh.PublicKey
+    interactive [][]string // Rounds of keyboard-interactive prompts
+    answers     [][]string // The answers expected for each round
+}
+
+func (l testLogin) serverConfig() *ssh.ServerConfig {
+    config := &ssh.ServerConfig{}
+    if l.password != "" {
+        config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+            if string(password) == l.password {
+                return nil, nil
+            }
+            return nil, errors.New("wrong password")
+        }
+    }
+    if l.key != nil || l.ca != nil {
+        checker := &ssh.CertChecker{
+            IsUserAuthority: func(auth ssh.PublicKey) bool {
+                return l.ca != nil && bytes.Equal(auth.Marshal(), l.ca.Marshal())
+            },
+            UserKeyFallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+                if l.key != nil && bytes.Equal(key.Marshal(), l.key.Marshal()) {
+                    return nil, nil
+                }
+                return nil, errors.New("unknown key")
+            },
+        }
+        config.PublicKeyCallback = checker.Authenticate
+    }
+    if len(l.interactive) > 0 {
+        config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+            for round, questions := range l.interactive {
+                answers, err := challenge("", "", questions, make([]bool, len(questions)))
+                if err != nil {
+                    return nil, err
+                }
+                if fmt.Sprint(answers) != fmt.Sprint(l.answers[round]) {
+                    return nil, fmt.Errorf("round %d: wrong answers %q", round+1, answers)
+                }
+            }
+            return nil, nil
+        }
+    }
+    return config
+}
+
+// TestAuthMethods logs in to a local SSH server with each supported method
+// and with lists of methods tried in order. The ssh package's server cannot
+// ask for a second method after a partial success, so chains required by
+// AuthenticationMethods are left to the client library; here each list is
+// confirmed to fall through to the method the server accepts.
+func TestAuthMethods(t *testing.T) {
+    keys := newTestKeys(t)
+    startTestAgent(t, keys.private)
+
+    bankPrompts := testLogin{
+        interactive: [][]string{{"Password: "}, {"One-time password: ", "Verification code: "}},
+        answers:     [][]string{{"secret"}, {"123456", "7890"}},
+    }
+
+    tests := []struct {
+        name        string
+        authMethods string
+        credentials Credentials
+        login       testLogin
+        wantErr     bool
+    }{
+        {
+            name:        "password",
+            authMethods: "password",
+            credentials: Credentials{Password: "secret"},
+            login:       testLogin{password: "secret"},
+        },
+        {
+            name:        "wrong password",
+            authMethods: "password",
+            credentials: Credentials{Password: "guess"},
+            login:       testLogin{password: "secret"},
+            wantErr:     true,
+        },
+        {
+            name:        "publickey",
+            authMethods: "publickey",
+            credentials: Credentials{PrivateKeyPath: keys.privateKeyPath},
+            login:       testLogin{key: keys.public},
+        },
+        {
+            name:        "publickey with certificate",
+            authMethods: "publickey",
+            credentials: Credentials{PrivateKeyPath: keys.privateKeyPath, CertificatePath: keys.certificatePath},
+            login:       testLogin{ca: keys.ca},
+        },
+        {
+            name:        "agent",
+            authMethods: "agent",
+            login:       testLogin{key: keys.public},
+        },
+        {
+            name:        "agent with certificate",
+            authMethods: "agent",
+            credentials: Credentials{CertificatePath: keys.certificatePath},
+            login:       testLogin{ca: keys.ca},
+        },
+        {
+            name:        "keyboard-interactive with overlapping prompts",
+            authMethods: "keyboard-interactive",
+            credentials: Credentials{KeyboardInteractiveAnswers: map[string]string{
+                "password":          "secret",
+                "one-time password": "123456",
+                "verification code": "7890",
+            }},
+            login: bankPrompts,
+        },
+        {
+            name:        "keyboard-interactive falling back to the password",
+            authMethods: "keyboard-interactive",
+            credentials: Credentials{Password: "secret", KeyboardInteractiveAnswers: map[string]string{
+                "one-time password": "123456",
+                "verification code": "7890",
+            }},
+            login: bankPrompts,
+        },
+        {
+            name:        "keyboard-interactive with an unknown prompt",
+            authMethods: "keyboard-interactive",
+            credentials: Credentials{Password: "secret"},
+            login:       bankPrompts,
+            wantErr:     true,
+        },
+        {
+            name:        "publickey then password",
+            authMethods: "publickey,password",
+            credentials: Credentials{PrivateKeyPath: keys.privateKeyPath, Password: "secret"},
+            login:       testLogin{password: "secret"},
+        },
+        {
+            name:        "agent then publickey",
+            authMethods: "agent,publickey",
+            credentials: Credentials{PrivateKeyPath: keys.privateKeyPath, CertificatePath: keys.certificatePath},
+            login:       testLogin{ca: keys.ca},
+        },
+        {
+            name:        "publickey then keyboard-interactive",
+            authMethods: "publickey,keyboard-interactive",
+            credentials: Credentials{PrivateKeyPath: keys.privateKeyPath, Password: "secret", KeyboardInteractiveAnswers: map[string]string{
+                "one-time password": "123456",
+                "verification code": "7890",
+            }},
+            login: bankPrompts,
+        },
+        {
+            name:        "default order with a key and a password",
+            credentials: Credentials{PrivateKeyPath: keys.privateKeyPath, Password: "secret"},
+            login:       testLogin{password: "secret"},
+        },
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            auth, err := NewAuthMethods(test.authMethods, test.credentials)
+            if err != nil {
+                t.Fatalf("NewAuthMethods: %v", err)
+            }
+            address := startTestServer(t, test.login.serverConfig(), 0)
+            client, err := dialTestServer(t, address, auth, Throughput{})
+            if test.wantErr {
+                if err == nil {
+                    client.Close()
+                    t.Fatal("logged in, want an error")
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("logging in: %v", err)
+            }
+            defer client.Close()
+            if _, err := client.Getwd(); err != nil {
+                t.Fatalf("using the SFTP session: %v", err)
+            }
+        })
+    }
+}
+
+// TestKeyboardInteractiveLongestMatch checks that the most specific entry
+// answers a prompt several entries match, whatever the map order.
+func TestKeyboardInteractiveLongestMatch(t *testing.T) {
+    challenge := keyboardInteractiveChallenge(Credentials{KeyboardInteractiveAnswers: map[string]string{
+        "password":          "secret",
+        "one-time password": "123456",
+        "time":              "wrong",
+    }})
+    for i := 0; i < 100; i++ {
+        answers, err := challenge("", "", []string{"Password:", "One-time password:"}, []bool{false, false})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if answers[0] != "secret" || answers[1] != "123456" {
+            t.Fatalf("answers %q, want [secret 123456]", answers)
+        }
+    }
+}
@@ -1,9 +1,11 @@
 package sftp
 
 import (
+    "errors"
     "log"
     "os"
     "path/filepath"
+    "strings"
     "time"
 )
 
@@ -32,3 +34,28 @@ func CleanUpArchive(archivePath string, cleanupDays int, logStream *log.Logger)
     })
     return err
 }
+
+// CleanUpPartFiles removes downloads left unfinished under localPath, named
+// with suffix, that have not been written to for maxAge. A localPath that
+// does not exist yet has nothing to clean up. A file that cannot be removed
+// is logged and left for the next run.
+func CleanUpPartFiles(localPath, suffix string, maxAge time.Duration, logStream *log.Logger) error {
+    cutoff := time.Now().Add(-maxAge)
+    return filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            if path == localPath && errors.Is(err, os.ErrNotExist) {
+                return nil
+            }
+            return err
+        }
+        if info.IsDir() || !strings.HasSuffix(info.Name(), suffix) || !info.ModTime().Before(cutoff) {
+            return nil
+        }
+        if err := os.Remove(path); err != nil {
+            logStream.Printf("Error removing stale partial download %s: %v", path, err)
+            return nil
+        }
+        logStream.Printf("Removed stale partial download %s", path)
+        return nil
+    })
+}
@@ -0,0 +1,51 @@
+package sftp
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCleanUpPartFiles(t *testing.T) {
+    if os.Getuid() == 0 {
+        t.Skip("root can remove files from a read-only folder")
+    }
+    root := t.TempDir()
+    writeFiles(t, root, "old.part", "locked/old.part", "new.part", "done.txt")
+    old := time.Now().Add(-48 * time.Hour)
+    for _, relPath := range []string{"old.part", "locked/old.part", "done.txt"} {
+        if err := os.Chtimes(filepath.Join(root, relPath), old, old); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // Files in a read-only folder cannot be removed.
+    locked := filepath.Join(root, "locked")
+    if err := os.Chmod(locked, 0555); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.Chmod(locked, 0755) })
+
+    var logged bytes.Buffer
+    if err := CleanUpPartFiles(root, ".part", 24*time.Hour, log.New(&logged, "", 0)); err != nil {
+        t.Fatal(err)
+    }
+    assertExists(t, filepath.Join(root, "old.part"), false)
+    assertExists(t, filepath.Join(root, "locked", "old.part"), true)
+    assertExists(t, filepath.Join(root, "new.part"), true)
+    assertExists(t, filepath.Join(root, "done.txt"), true)
+    if !strings.Contains(logged.String(), "Error removing stale partial download "+filepath.Join(locked, "old.part")) {
+        t.Errorf("failed removal not logged:\n%s", logged.String())
+    }
+}
+
+func TestCleanUpPartFilesMissingRoot(t *testing.T) {
+    missing := filepath.Join(t.TempDir(), "not yet created")
+    if err := CleanUpPartFiles(missing, ".part", time.Hour, log.New(io.Discard, "", 0)); err != nil {
+        t.Errorf("missing folder returned %v", err)
+    }
+}
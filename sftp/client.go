@@ -1,29 +1,245 @@
 package sftp
 
 import (
+	"fmt"
+	"log"
+	"net"
 	"strconv"
+	"time"
+
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
-func NewSFTPClient(username, password, server string, port int) (*sftp.Client, error) {
+// Hop is an SSH server on the way to (or being) the customer's SFTP server.
+type Hop struct {
+	Address string
+	Config  *ssh.ClientConfig
+}
+
+// Timeouts bounds each step of connecting to a hop. A zero Connect or
+// Handshake uses DefaultTimeout; a zero KeepAlive sends no keepalives.
+type Timeouts struct {
+	Connect            time.Duration
+	Handshake          time.Duration
+	KeepAlive          time.Duration
+	KeepAliveMaxMissed int
+}
+
+const DefaultTimeout = 30 * time.Second
+
+// Throughput tunes how much data the SFTP session keeps in flight, which is
+// what limits transfer speed over high-latency links. Zero values keep the
+// pkg/sftp defaults: 32 KiB packets, 64 requests per file, concurrent reads
+// on and concurrent writes off.
+type Throughput struct {
+	MaxPacketSize                int
+	MaxConcurrentRequestsPerFile int
+	DisableConcurrentReads       bool
+	UseConcurrentWrites          bool
+}
+
+func (t Throughput) options() []sftp.ClientOption {
+	options := []sftp.ClientOption{
+		sftp.UseConcurrentReads(!t.DisableConcurrentReads),
+		sftp.UseConcurrentWrites(t.UseConcurrentWrites),
+	}
+	if t.MaxPacketSize > 32768 {
+		// Above the 32 KiB every server must accept; OpenSSH takes up to 256 KiB.
+		options = append(options, sftp.MaxPacketUnchecked(t.MaxPacketSize))
+	} else if t.MaxPacketSize > 0 {
+		options = append(options, sftp.MaxPacketChecked(t.MaxPacketSize))
+	}
+	if t.MaxConcurrentRequestsPerFile > 0 {
+		options = append(options, sftp.MaxConcurrentRequestsPerFile(t.MaxConcurrentRequestsPerFile))
+	}
+	return options
+}
+
+// Client is an SFTP session together with the SSH connections it runs over.
+type Client struct {
+	*sftp.Client
+	Address string // The SFTP server the session is connected to
+	conns   []*ssh.Client
+}
+
+// NewHop describes how to log in to server:port.
+func NewHop(username string, auth []ssh.AuthMethod, server string, port int, hostKeyCallback ssh.HostKeyCallback, algorithms Algorithms) Hop {
 	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}
+	algorithms.apply(config)
+
+	return Hop{
+		Address: net.JoinHostPort(server, strconv.Itoa(port)),
+		Config:  config,
+	}
+}
+
+// NewSFTPClient connects to target, tunnelling through jumpHosts in order
+// the way ssh -J does: the first hop is dialed with dialer, and each later
+// hop from the SSH connection to the one before it.
+func NewSFTPClient(dialer Dialer, target Hop, jumpHosts []Hop, timeouts Timeouts, throughput Throughput, logStream *log.Logger) (*Client, error) {
+	if timeouts.Connect <= 0 {
+		timeouts.Connect = DefaultTimeout
+	}
+	if timeouts.Handshake <= 0 {
+		timeouts.Handshake = DefaultTimeout
+	}
+	if timeouts.KeepAliveMaxMissed <= 0 {
+		timeouts.KeepAliveMaxMissed = 3
+	}
+
+	client := &Client{Address: target.Address}
+
+	hops := append(append([]Hop{}, jumpHosts...), target)
+
+	var previous *ssh.Client
+	for i, hop := range hops {
+		conn, err := dialHop(dialer, previous, hop, timeouts, logStream)
+		if err != nil {
+			client.Close()
+			if i < len(jumpHosts) {
+				return nil, fmt.Errorf("jump host %s: %w", hop.Address, err)
+			}
+			return nil, err
+		}
+		client.conns = append(client.conns, conn)
+		previous = conn
+
+		if timeouts.KeepAlive > 0 {
+			go keepAlive(conn, hop.Address, timeouts.KeepAlive, timeouts.KeepAliveMaxMissed, logStream)
+		}
+	}
+
+	timer := time.AfterFunc(timeouts.Handshake, func() { previous.Close() })
+	sftpClient, err := sftp.NewClient(previous, throughput.options()...)
+	if !timer.Stop() {
+		err = &timeoutError{fmt.Sprintf("starting sftp subsystem on %s timed out after %s", target.Address, timeouts.Handshake)}
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.Client = sftpClient
+
+	return client, nil
+}
+
+func dialHop(dialer Dialer, previous *ssh.Client, hop Hop, timeouts Timeouts, logStream *log.Logger) (*ssh.Client, error) {
+	if previous != nil {
+		dialer = previous
 	}
 
-	conn, err := ssh.Dial("tcp", server+":"+strconv.Itoa(port), config)
+	rawConn, err := dialWithTimeout(dialer, hop.Address, timeouts.Connect)
 	if err != nil {
 		return nil, err
 	}
+	netConn := &kexInitConn{Conn: rawConn}
 
-	client, err := sftp.NewClient(conn)
+	// Closing the connection is the only way to interrupt a handshake on a
+	// tunnelled hop, whose channel connection does not support deadlines.
+	timer := time.AfterFunc(timeouts.Handshake, func() { netConn.Close() })
+	conn, chans, reqs, err := ssh.NewClientConn(netConn, hop.Address, hop.Config)
+	if !timer.Stop() {
+		err = &timeoutError{fmt.Sprintf("ssh handshake with %s timed out after %s", hop.Address, timeouts.Handshake)}
+	}
 	if err != nil {
+		netConn.Close()
 		return nil, err
 	}
+	warnWeakAlgorithms(hop.Address, hop.Config, netConn, logStream)
+	return ssh.NewClient(conn, chans, reqs), nil
+}
 
-	return client, nil
+// dialWithTimeout gives up on a dial after timeout, closing the connection
+// if it is established later.
+func dialWithTimeout(dialer Dialer, address string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial("tcp", address)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, &timeoutError{fmt.Sprintf("connecting to %s timed out after %s", address, timeout)}
+	}
+}
+
+type timeoutError struct{ message string }
+
+func (e *timeoutError) Error() string { return e.message }
+func (e *timeoutError) Timeout() bool { return true }
+
+// keepAlive sends keepalive@openssh.com requests every interval and closes
+// conn once maxMissed of them in a row get no reply, so transfers on a dead
+// session fail instead of hanging.
+func keepAlive(conn *ssh.Client, address string, interval time.Duration, maxMissed int, logStream *log.Logger) {
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-closed:
+			return
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			logStream.Printf("No keepalive reply from %s (%d/%d)", address, missed, maxMissed)
+			if missed >= maxMissed {
+				logStream.Printf("Closing dead SSH session to %s", address)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Close ends the SFTP session and closes the SSH connections, last hop first.
+func (c *Client) Close() error {
+	var err error
+	if c.Client != nil {
+		err = c.Client.Close()
+	}
+	for i := len(c.conns) - 1; i >= 0; i-- {
+		c.conns[i].Close()
+	}
+	return err
 }
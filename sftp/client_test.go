@@ -0,0 +1,107 @@
+package sftp
+
+import (
+    "crypto/rand"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// benchmarkLatency is the one-way delay of the benchmark server, as on a
+// link with a 20 ms round trip.
+const benchmarkLatency = 10 * time.Millisecond
+
+const benchmarkFileSize = 4 << 20
+
+var benchmarkThroughputs = []struct {
+    name       string
+    throughput Throughput
+}{
+    {"sequential", Throughput{DisableConcurrentReads: true}},
+    {"defaults", Throughput{}},
+    {"concurrent", Throughput{UseConcurrentWrites: true}},
+    {"concurrent 8 requests", Throughput{UseConcurrentWrites: true, MaxConcurrentRequestsPerFile: 8}},
+}
+
+// benchmarkSetup starts a server behind benchmarkLatency, connects to it
+// with throughput and returns the client and a folder holding a test file.
+func benchmarkSetup(b *testing.B, throughput Throughput) (*Client, string) {
+    b.Helper()
+    address := startTestServer(b, &ssh.ServerConfig{NoClientAuth: true}, benchmarkLatency)
+    client, err := dialTestServer(b, address, nil, throughput)
+    if err != nil {
+        b.Fatal(err)
+    }
+    b.Cleanup(func() { client.Close() })
+
+    dir := b.TempDir()
+    data := make([]byte, benchmarkFileSize)
+    if _, err := rand.Read(data); err != nil {
+        b.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, "source.bin"), data, 0644); err != nil {
+        b.Fatal(err)
+    }
+    return client, dir
+}
+
+// BenchmarkUploadFile uploads a file over a high-latency link with each
+// throughput setting. Without concurrent writes each packet waits for the
+// one before it to be acknowledged.
+func BenchmarkUploadFile(b *testing.B) {
+    logStream := log.New(io.Discard, "", 0)
+    for _, bt := range benchmarkThroughputs {
+        b.Run(bt.name, func(b *testing.B) {
+            client, dir := benchmarkSetup(b, bt.throughput)
+            localFile := filepath.Join(dir, "source.bin")
+            info, err := os.Stat(localFile)
+            if err != nil {
+                b.Fatal(err)
+            }
+            remotePath := filepath.Join(dir, "remote")
+            if err := os.Mkdir(remotePath, 0755); err != nil {
+                b.Fatal(err)
+            }
+            job := transferJob{source: localFile, relPath: "source.bin", info: info}
+
+            b.SetBytes(benchmarkFileSize)
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                if err := uploadFile(client, job, remotePath, UploadOptions{}, logStream, &Results{}); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+// BenchmarkDownloadFile downloads a file over a high-latency link with each
+// throughput setting. Concurrent reads are on by default.
+func BenchmarkDownloadFile(b *testing.B) {
+    logStream := log.New(io.Discard, "", 0)
+    for _, bt := range benchmarkThroughputs {
+        b.Run(bt.name, func(b *testing.B) {
+            client, dir := benchmarkSetup(b, bt.throughput)
+            remoteFile := filepath.Join(dir, "source.bin")
+            info, err := os.Stat(remoteFile)
+            if err != nil {
+                b.Fatal(err)
+            }
+            localFile := filepath.Join(dir, "downloaded.bin")
+            job := transferJob{source: remoteFile, target: localFile, relPath: "source.bin", info: info}
+
+            b.SetBytes(benchmarkFileSize)
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                if err := downloadFile(client, job, DownloadOptions{}, logStream); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,98 @@
+package sftp
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ConflictPolicy says what to do when an upload's final remote path is
+// already taken.
+type ConflictPolicy string
+
+const (
+    ConflictOverwrite       ConflictPolicy = "overwrite"        // Replace the remote file
+    ConflictSkip            ConflictPolicy = "skip"             // Leave the remote file and keep the local one for later
+    ConflictFail            ConflictPolicy = "fail"             // Report the file as failed
+    ConflictRenameTimestamp ConflictPolicy = "rename-timestamp" // Upload as name_YYYYMMDD-HHMMSS.ext
+    ConflictRenameCounter   ConflictPolicy = "rename-counter"   // Upload as name_1.ext, name_2.ext, ...
+    ConflictNewer           ConflictPolicy = "newer"            // Overwrite if the local file is newer, otherwise skip
+    ConflictDifferentSize   ConflictPolicy = "different-size"   // Overwrite if the sizes differ, otherwise skip
+)
+
+// ParseConflictPolicy checks a configured policy. Empty means overwrite.
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+    p := ConflictPolicy(strings.ToLower(strings.TrimSpace(policy)))
+    switch p {
+    case "":
+        return ConflictOverwrite, nil
+    case ConflictOverwrite, ConflictSkip, ConflictFail, ConflictRenameTimestamp, ConflictRenameCounter, ConflictNewer, ConflictDifferentSize:
+        return p, nil
+    }
+    return "", fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+// Conflict records what was done about an upload whose remote path was
+// already taken.
+type Conflict struct {
+    File       string // The local file
+    RemoteFile string // The path it was uploaded to, or would have been
+    Decision   string
+}
+
+// errSkipped marks a file that was deliberately not uploaded.
+var errSkipped = errors.New("skipped")
+
+// resolveConflict applies policy when finalFile already exists. It returns
+// the path to upload to and the decision taken, which is empty when there
+// was no conflict. A skipped file returns an error wrapping errSkipped.
+func resolveConflict(client *Client, local os.FileInfo, finalFile string, policy ConflictPolicy, now time.Time) (string, string, error) {
+    remote, err := client.Stat(finalFile)
+    if errors.Is(err, os.ErrNotExist) {
+        return finalFile, "", nil
+    }
+    if err != nil {
+        return "", "", err
+    }
+
+    switch policy {
+    case ConflictSkip:
+        return "", "skipped, remote file exists", fmt.Errorf("%w: %s already exists", errSkipped, finalFile)
+    case ConflictFail:
+        return "", "failed, remote file exists", fmt.Errorf("%s already exists", finalFile)
+    case ConflictNewer:
+        if !local.ModTime().After(remote.ModTime()) {
+            return "", "skipped, remote file is not older", fmt.Errorf("%w: %s is not older than the local file", errSkipped, finalFile)
+        }
+        return finalFile, "overwritten, local file is newer", nil
+    case ConflictDifferentSize:
+        if local.Size() == remote.Size() {
+            return "", "skipped, same size", fmt.Errorf("%w: %s has the same size", errSkipped, finalFile)
+        }
+        return finalFile, "overwritten, size differs", nil
+    case ConflictRenameTimestamp:
+        renamed := withSuffix(finalFile, "_"+now.Format("20060102-150405"))
+        return renamed, "renamed to " + filepath.Base(renamed), nil
+    case ConflictRenameCounter:
+        for i := 1; ; i++ {
+            renamed := withSuffix(finalFile, "_"+strconv.Itoa(i))
+            if _, err := client.Stat(renamed); errors.Is(err, os.ErrNotExist) {
+                return renamed, "renamed to " + filepath.Base(renamed), nil
+            } else if err != nil {
+                return "", "", err
+            }
+        }
+    default:
+        return finalFile, "overwritten", nil
+    }
+}
+
+// withSuffix inserts suffix before the extension of path.
+func withSuffix(path, suffix string) string {
+    ext := filepath.Ext(path)
+    return strings.TrimSuffix(path, ext) + suffix + ext
+}
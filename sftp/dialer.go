@@ -0,0 +1,141 @@
+package sftp
+
+import (
+    "bufio"
+    "encoding/base64"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+
+    "golang.org/x/net/proxy"
+)
+
+// Dialer opens the TCP connection to the first SSH hop. proxy.Direct dials
+// straight out; NewProxyDialer returns one that goes through a proxy.
+type Dialer interface {
+    Dial(network, address string) (net.Conn, error)
+}
+
+func init() {
+    proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// NewProxyDialer returns the dialer for proxyURL, which is a
+// socks5://[user[:password]@]host:port or http://[user[:password]@]host:port
+// (HTTP CONNECT) URL. password, when set, replaces the one in proxyURL.
+// An empty proxyURL falls back to the ALL_PROXY environment variable, and
+// "direct" connects without any proxy. Hosts listed in NO_PROXY are always
+// dialed directly.
+func NewProxyDialer(proxyURL, password string) (Dialer, error) {
+    switch strings.ToLower(strings.TrimSpace(proxyURL)) {
+    case "":
+        return proxy.FromEnvironment(), nil
+    case "direct", "none":
+        return proxy.Direct, nil
+    }
+
+    u, err := url.Parse(proxyURL)
+    if err != nil {
+        return nil, fmt.Errorf("invalid proxy URL: %w", err)
+    }
+    if password != "" {
+        username := ""
+        if u.User != nil {
+            username = u.User.Username()
+        }
+        u.User = url.UserPassword(username, password)
+    }
+
+    dialer, err := proxy.FromURL(u, proxy.Direct)
+    if err != nil {
+        return nil, fmt.Errorf("invalid proxy URL %s: %w", RedactProxyURL(proxyURL), err)
+    }
+
+    noProxy := os.Getenv("NO_PROXY")
+    if noProxy == "" {
+        noProxy = os.Getenv("no_proxy")
+    }
+    if noProxy == "" {
+        return dialer, nil
+    }
+    perHost := proxy.NewPerHost(dialer, proxy.Direct)
+    perHost.AddFromString(noProxy)
+    return perHost, nil
+}
+
+// RedactProxyURL hides the password in proxyURL so it can be logged.
+func RedactProxyURL(proxyURL string) string {
+    u, err := url.Parse(proxyURL)
+    if err != nil || u.User == nil {
+        return proxyURL
+    }
+    return u.Redacted()
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with CONNECT.
+type httpConnectDialer struct {
+    proxyAddress string
+    user         *url.Userinfo
+    forward      proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+    proxyAddress := u.Host
+    if u.Port() == "" {
+        proxyAddress = net.JoinHostPort(u.Hostname(), "80")
+    }
+    return &httpConnectDialer{proxyAddress: proxyAddress, user: u.User, forward: forward}, nil
+}
+
+func (d *httpConnectDialer) Dial(network, address string) (net.Conn, error) {
+    conn, err := d.forward.Dial(network, d.proxyAddress)
+    if err != nil {
+        return nil, err
+    }
+
+    req := &http.Request{
+        Method: http.MethodConnect,
+        URL:    &url.URL{Opaque: address},
+        Host:   address,
+        Header: make(http.Header),
+    }
+    if d.user != nil {
+        password, _ := d.user.Password()
+        credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+        req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+    }
+    if err := req.Write(conn); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    reader := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        conn.Close()
+        return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", d.proxyAddress, address, resp.Status)
+    }
+
+    if reader.Buffered() > 0 {
+        return &bufferedConn{Conn: conn, reader: reader}, nil
+    }
+    return conn, nil
+}
+
+// bufferedConn returns bytes the proxy sent right after its CONNECT reply
+// before reading from the connection again.
+type bufferedConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+    return c.reader.Read(p)
+}
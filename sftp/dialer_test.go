@@ -0,0 +1,207 @@
+package sftp
+
+import (
+    "bufio"
+    "encoding/base64"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// connectProxy is an HTTP proxy that tunnels CONNECT requests, optionally
+// only for one set of credentials, and records what it was asked.
+type connectProxy struct {
+    credentials string // "user:password" to require, empty for none
+    early       string // Sent straight after the 200 reply, in the same write
+
+    mu            sync.Mutex
+    target        string
+    authorization string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    p.mu.Lock()
+    p.target = r.Host
+    p.authorization = r.Header.Get("Proxy-Authorization")
+    p.mu.Unlock()
+
+    if r.Method != http.MethodConnect {
+        http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+        return
+    }
+    if p.credentials != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(p.credentials)) {
+        http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+        return
+    }
+    target, err := net.Dial("tcp", r.Host)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    }
+    conn, _, err := w.(http.Hijacker).Hijack()
+    if err != nil {
+        target.Close()
+        return
+    }
+    if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"+p.early); err != nil {
+        conn.Close()
+        target.Close()
+        return
+    }
+    go func() {
+        io.Copy(target, conn)
+        target.Close()
+    }()
+    io.Copy(conn, target)
+    conn.Close()
+}
+
+func (p *connectProxy) asked() (string, string) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.target, p.authorization
+}
+
+// startEchoServer returns the address of a TCP server that sends back
+// whatever it is sent.
+func startEchoServer(t *testing.T) string {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                io.Copy(conn, conn)
+                conn.Close()
+            }()
+        }
+    }()
+    return listener.Addr().String()
+}
+
+// dialThroughProxy dials target through an HTTP CONNECT proxy at proxyURL,
+// with no NO_PROXY exceptions.
+func dialThroughProxy(t *testing.T, proxyURL, password, target string) (net.Conn, error) {
+    t.Helper()
+    t.Setenv("NO_PROXY", "")
+    t.Setenv("no_proxy", "")
+    dialer, err := NewProxyDialer(proxyURL, password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return dialer.Dial("tcp", target)
+}
+
+func assertEcho(t *testing.T, conn net.Conn, want string) {
+    t.Helper()
+    if _, err := io.WriteString(conn, "ping\n"); err != nil {
+        t.Fatal(err)
+    }
+    got, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != want {
+        t.Errorf("read %q through the tunnel, want %q", got, want)
+    }
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+    target := startEchoServer(t)
+    tests := []struct {
+        name     string
+        userinfo string // In the proxy URL
+        password string // Passed to NewProxyDialer
+        want     string // Credentials the proxy should see
+    }{
+        {"no credentials", "", "", ""},
+        {"credentials in URL", "user:secret@", "", "user:secret"},
+        {"password replaced", "user:stale@", "secret", "user:secret"},
+        {"password added", "user@", "secret", "user:secret"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            p := &connectProxy{credentials: test.want}
+            server := httptest.NewServer(p)
+            defer server.Close()
+
+            proxyURL := "http://" + test.userinfo + strings.TrimPrefix(server.URL, "http://")
+            conn, err := dialThroughProxy(t, proxyURL, test.password, target)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer conn.Close()
+            assertEcho(t, conn, "ping\n")
+
+            asked, authorization := p.asked()
+            if asked != target {
+                t.Errorf("proxy was asked for %s, want %s", asked, target)
+            }
+            want := ""
+            if test.want != "" {
+                want = "Basic " + base64.StdEncoding.EncodeToString([]byte(test.want))
+            }
+            if authorization != want {
+                t.Errorf("Proxy-Authorization = %q, want %q", authorization, want)
+            }
+        })
+    }
+}
+
+func TestHTTPConnectDialerRefused(t *testing.T) {
+    target := startEchoServer(t)
+    server := httptest.NewServer(&connectProxy{credentials: "user:secret"})
+    defer server.Close()
+    address := strings.TrimPrefix(server.URL, "http://")
+
+    for _, userinfo := range []string{"", "user:wrong@"} {
+        conn, err := dialThroughProxy(t, "http://"+userinfo+address, "", target)
+        if err == nil {
+            conn.Close()
+            t.Errorf("dial with %q succeeded, want it refused", userinfo)
+            continue
+        }
+        if !strings.Contains(err.Error(), "refused CONNECT") || !strings.Contains(err.Error(), "407") {
+            t.Errorf("dial with %q returned %v, want a 407 refusal", userinfo, err)
+        }
+    }
+}
+
+// TestHTTPConnectDialerEarlyBytes checks that bytes the proxy sends in the
+// same packet as its reply, such as an eager SSH banner, are not lost.
+func TestHTTPConnectDialerEarlyBytes(t *testing.T) {
+    target := startEchoServer(t)
+    server := httptest.NewServer(&connectProxy{early: "SSH-2.0-early\r\n"})
+    defer server.Close()
+
+    conn, err := dialThroughProxy(t, server.URL, "", target)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    if _, ok := conn.(*bufferedConn); !ok {
+        t.Fatalf("dial returned a %T, want the buffered connection", conn)
+    }
+    reader := bufio.NewReader(conn)
+    banner, err := reader.ReadString('\n')
+    if err != nil || banner != "SSH-2.0-early\r\n" {
+        t.Fatalf("first line %q, %v, want the early banner", banner, err)
+    }
+    if _, err := io.WriteString(conn, "ping\n"); err != nil {
+        t.Fatal(err)
+    }
+    if echo, err := reader.ReadString('\n'); err != nil || echo != "ping\n" {
+        t.Errorf("read %q, %v through the tunnel, want the echo", echo, err)
+    }
+}
@@ -1,67 +1,148 @@
 package sftp
 
 import (
+    "io"
     "log"
     "os"
     "path/filepath"
-    "strings"
-
-    "github.com/pkg/sftp"
 )
 
-func DownloadDirectory(client *sftp.Client, localPath, remotePath, fileExtensions string, logStream *log.Logger, downloadedFiles *[]string, downloadRootOnly, deleteAfterDownload bool) error {
-    extensions := strings.Split(fileExtensions, ",")
+// DownloadOptions are the per-customer settings for DownloadDirectory.
+type DownloadOptions struct {
+    Filter              *Filter // Files to download, nil for all
+    DryRun              bool    // Only log what would be downloaded
+    DownloadRootOnly    bool
+    MaxDepth            int  // Levels of subfolders to download, 0 for all
+    Flatten             bool // Download every file into localPath itself
+    DeleteAfterDownload bool
+    PartSuffix          string       // Suffix of files being downloaded, default ".part"
+    Markers             MarkerPolicy // Remote source markers, local destination markers
+    Attributes          FileAttributes
+    Checksums           bool      // Compare hashes as well as sizes after each download
+    Workers             int       // Files downloaded at once, default 1
+    Pool                []*Client // Extra sessions the workers spread files over
+    Throttle            *Throttle
+    Sync                *SyncState // Only download new and changed files, nil to download all
+}
+
+// DownloadDirectory downloads the matching files under remotePath to
+// localPath with options.Workers workers, recording each remote file in
+// results. Files are handed to the workers as directories are listed, so
+// listing and transfers overlap.
+func DownloadDirectory(client *Client, localPath, remotePath string, options DownloadOptions, logStream *log.Logger, results *Results) error {
+    p := pipeline{
+        verb:     "downloading",
+        clients:  append([]*Client{client}, options.Pool...),
+        workers:  options.Workers,
+        dryRun:   options.DryRun,
+        rootOnly: options.DownloadRootOnly,
+        maxDepth: options.MaxDepth,
+        flatten:  options.Flatten,
+        filter:   options.Filter,
+        markers:  options.Markers,
+        sync:     options.Sync,
+        readDir:  client.ReadDir,
+        newJob: func(dir, relPath string, info os.FileInfo) transferJob {
+            localFile := filepath.Join(localPath, relPath)
+            if options.Flatten {
+                localFile = filepath.Join(localPath, info.Name())
+            }
+            return transferJob{source: filepath.Join(dir, info.Name()), target: localFile, relPath: relPath, info: info}
+        },
+        hash: func(job transferJob) (string, error) {
+            return remoteHash(client, job.source), nil
+        },
+        transfer: func(client *Client, job transferJob) error {
+            return downloadFile(client, job, options, logStream)
+        },
+        copies: "local folder",
+        remove: os.Remove,
+    }
+    return p.run(remotePath, logStream, results)
+}
+
+// downloadFile writes remoteFile to localFile plus the part suffix, picking
+// up where an earlier run left off, and renames it to localFile once it is
+// complete and synced to disk.
+func downloadFile(client *Client, job transferJob, options DownloadOptions, logStream *log.Logger) error {
+    localFile, remoteFile := job.target, job.source
+    if options.DryRun {
+        logStream.Printf("Dry run: would download %s to %s", remoteFile, localFile)
+        return nil
+    }
+    suffix := options.PartSuffix
+    if suffix == "" {
+        suffix = DefaultPartSuffix
+    }
+    partFile := localFile + suffix
+
+    if err := options.Attributes.mkdirLocal(filepath.Dir(localFile)); err != nil {
+        return err
+    }
 
-    files, err := client.ReadDir(remotePath)
+    srcFile, err := client.Open(remoteFile)
     if err != nil {
         return err
     }
+    defer srcFile.Close()
 
-    for _, file := range files {
-        if file.IsDir() && !downloadRootOnly {
-            subDir := filepath.Join(localPath, file.Name())
-            remoteSubDir := filepath.Join(remotePath, file.Name())
-            err = DownloadDirectory(client, subDir, remoteSubDir, fileExtensions, logStream, downloadedFiles, downloadRootOnly, deleteAfterDownload)
-            if err != nil {
-                return err
-            }
-        } else {
-            ext := strings.TrimPrefix(filepath.Ext(file.Name()), ".")
-            if fileExtensions == "" || contains(extensions, ext) {
-                localFile := filepath.Join(localPath, file.Name())
-                remoteFile := filepath.Join(remotePath, file.Name())
+    offset, err := downloadResumeOffset(srcFile, partFile, logStream)
+    if err != nil {
+        return err
+    }
 
-                err := downloadFile(client, localFile, remoteFile, logStream, downloadedFiles, deleteAfterDownload)
-                if err != nil {
-                    logStream.Printf("Error downloading file %s: %s", remoteFile, err)
-                }
-            }
+    var dstFile *os.File
+    if offset > 0 {
+        logStream.Printf("Resuming download of %s at %d bytes", remoteFile, offset)
+        dstFile, err = os.OpenFile(partFile, os.O_WRONLY, 0)
+        if err == nil {
+            _, err = dstFile.Seek(offset, io.SeekStart)
+        }
+        if err == nil {
+            _, err = srcFile.Seek(offset, io.SeekStart)
         }
+    } else {
+        dstFile, err = os.Create(partFile)
+    }
+    if dstFile != nil {
+        defer dstFile.Close()
     }
-    return nil
-}
-
-func downloadFile(client *sftp.Client, localFile, remoteFile string, logStream *log.Logger, downloadedFiles *[]string, deleteAfterDownload bool) error {
-    dstFile, err := os.Create(localFile)
     if err != nil {
         return err
     }
-    defer dstFile.Close()
 
-    srcFile, err := client.Open(remoteFile)
+    var dst io.Writer = dstFile
+    if options.Throttle != nil {
+        dst = &throttledWriter{w: dstFile, throttle: options.Throttle}
+    }
+
+    if _, err := srcFile.WriteTo(dst); err != nil {
+        return err
+    }
+    // The remote copy is only deleted once this file is safely written.
+    if err := dstFile.Sync(); err != nil {
+        return err
+    }
+    if err := dstFile.Close(); err != nil {
+        return err
+    }
+    if err := verifyCopy(client, remoteFile, partFile, options.Checksums, offset, os.Remove, partFile, logStream); err != nil {
+        return err
+    }
+    remoteInfo, err := srcFile.Stat()
     if err != nil {
         return err
     }
-    defer srcFile.Close()
-
-    if _, err := srcFile.WriteTo(dstFile); err != nil {
+    if err := options.Attributes.applyLocal(partFile, remoteInfo, logStream); err != nil {
+        return err
+    }
+    if err := os.Rename(partFile, localFile); err != nil {
         return err
     }
 
     logStream.Printf("Downloaded %s to %s", remoteFile, localFile)
-    *downloadedFiles = append(*downloadedFiles, remoteFile)
 
-    if deleteAfterDownload {
+    if options.DeleteAfterDownload {
         err := client.Remove(remoteFile)
         if err != nil {
             logStream.Printf("Failed to delete %s from remote server: %s", remoteFile, err)
@@ -69,5 +150,20 @@ func downloadFile(client *sftp.Client, localFile, remoteFile string, logStream *
         }
         logStream.Printf("Deleted %s from remote server", remoteFile)
     }
+
+    if options.Markers.Destination != "" {
+        if err := os.WriteFile(localFile+options.Markers.Destination, nil, 0644); err != nil {
+            return err
+        }
+        logStream.Printf("Wrote marker %s", localFile+options.Markers.Destination)
+    }
+    if options.Markers.deleteSource() {
+        if err := client.Remove(remoteFile + options.Markers.Source); err != nil {
+            logStream.Printf("Failed to remove marker %s from remote server: %v", remoteFile+options.Markers.Source, err)
+        }
+    }
+    if options.Sync != nil {
+        options.Sync.record(job.relPath, FileState{Size: job.info.Size(), ModTime: job.info.ModTime(), Hash: job.hash, Destination: localFile})
+    }
     return nil
 }
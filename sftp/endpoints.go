@@ -0,0 +1,68 @@
+package sftp
+
+import (
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// OrderEndpoints returns the order in which to try a customer's endpoints.
+// With the "failover" strategy (the default) they are tried as listed, so
+// the first one is the primary. With "round-robin" a run starts at the
+// endpoint after previous, the one that served the last run, and fails
+// over to the others from there.
+func OrderEndpoints(endpoints []string, strategy string, previous string) []string {
+    if len(endpoints) < 2 || !strings.EqualFold(strings.TrimSpace(strategy), "round-robin") {
+        return endpoints
+    }
+
+    start := 0
+    for i, endpoint := range endpoints {
+        if endpoint == previous {
+            start = (i + 1) % len(endpoints)
+            break
+        }
+    }
+    return append(append([]string{}, endpoints[start:]...), endpoints[:start]...)
+}
+
+// LastRun records which endpoint served a customer's latest run, for the
+// web server's status page.
+type LastRun struct {
+    Endpoint string    // host:port the job logged in to
+    Started  time.Time // When the job connected
+}
+
+// LoadLastRun reads the record kept in path. A missing file, as before a
+// customer's first run, is an empty record.
+func LoadLastRun(path string) (LastRun, error) {
+    var run LastRun
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return run, nil
+    }
+    if err != nil {
+        return run, err
+    }
+    err = json.Unmarshal(data, &run)
+    return run, err
+}
+
+// SaveLastRun writes run to path, replacing it atomically.
+func SaveLastRun(path string, run LastRun) error {
+    data, err := json.MarshalIndent(run, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
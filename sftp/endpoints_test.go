@@ -0,0 +1,49 @@
+package sftp
+
+import (
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestOrderEndpoints(t *testing.T) {
+    endpoints := []string{"a:22", "b:22", "c:22"}
+    tests := []struct {
+        strategy string
+        previous string
+        want     []string
+    }{
+        {"", "b:22", endpoints},
+        {"failover", "a:22", endpoints},
+        {"round-robin", "", endpoints},
+        {"round-robin", "a:22", []string{"b:22", "c:22", "a:22"}},
+        {"Round-Robin", "c:22", endpoints},
+        {"round-robin", "gone:22", endpoints},
+    }
+    for _, test := range tests {
+        if got := OrderEndpoints(endpoints, test.strategy, test.previous); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("OrderEndpoints(%q, %q) = %v, want %v", test.strategy, test.previous, got, test.want)
+        }
+    }
+}
+
+// TestRoundRobinAcrossRuns checks that the rotation carries over between
+// processes, through the last-run file each run leaves behind.
+func TestRoundRobinAcrossRuns(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state", "customer-last-run.json")
+    endpoints := []string{"a:22", "b:22", "c:22"}
+    for _, want := range []string{"a:22", "b:22", "c:22", "a:22"} {
+        lastRun, err := LoadLastRun(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        served := OrderEndpoints(endpoints, "round-robin", lastRun.Endpoint)[0]
+        if served != want {
+            t.Fatalf("run after %q started at %s, want %s", lastRun.Endpoint, served, want)
+        }
+        if err := SaveLastRun(path, LastRun{Endpoint: served, Started: time.Now()}); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
@@ -0,0 +1,147 @@
+package sftp
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// Filter selects the files to transfer. Patterns are matched against the
+// path relative to the folder being transferred, with "/" separators. A
+// pattern starting with "re:" is a regular expression; anything else is a
+// glob where * and ? stay within a folder and ** matches across folders. A
+// glob without a "/" is matched against the file name alone.
+type Filter struct {
+    extensions []string // Lower case, without the dot
+    include    []*regexp.Regexp
+    exclude    []*regexp.Regexp
+    minSize    int64
+    maxSize    int64
+    minAge     time.Duration
+    maxAge     time.Duration
+}
+
+// NewFilter returns a filter for the comma-separated extensions and the
+// include and exclude patterns. Zero sizes and ages are no limit.
+func NewFilter(extensions string, include, exclude []string, minSize, maxSize int64, minAge, maxAge time.Duration) (*Filter, error) {
+    f := &Filter{minSize: minSize, maxSize: maxSize, minAge: minAge, maxAge: maxAge}
+    for _, ext := range splitList(extensions) {
+        f.extensions = append(f.extensions, strings.ToLower(strings.TrimPrefix(ext, ".")))
+    }
+
+    var err error
+    if f.include, err = compilePatterns(include); err != nil {
+        return nil, err
+    }
+    if f.exclude, err = compilePatterns(exclude); err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+    compiled := []*regexp.Regexp{}
+    for _, pattern := range patterns {
+        pattern = strings.TrimSpace(pattern)
+        if pattern == "" {
+            continue
+        }
+        expr := globToRegexp(pattern)
+        if strings.HasPrefix(pattern, "re:") {
+            expr = strings.TrimPrefix(pattern, "re:")
+        }
+        re, err := regexp.Compile(expr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+        }
+        compiled = append(compiled, re)
+    }
+    return compiled, nil
+}
+
+func globToRegexp(glob string) string {
+    var expr strings.Builder
+    if !strings.Contains(glob, "/") {
+        expr.WriteString("(^|/)") // Any folder
+    } else {
+        expr.WriteString("^")
+    }
+    for i := 0; i < len(glob); i++ {
+        switch c := glob[i]; {
+        case strings.HasPrefix(glob[i:], "**/"):
+            expr.WriteString("(.*/)?")
+            i += 2
+        case strings.HasPrefix(glob[i:], "**"):
+            expr.WriteString(".*")
+            i++
+        case c == '*':
+            expr.WriteString("[^/]*")
+        case c == '?':
+            expr.WriteString("[^/]")
+        default:
+            expr.WriteString(regexp.QuoteMeta(string(c)))
+        }
+    }
+    expr.WriteString("$")
+    return expr.String()
+}
+
+// Match reports whether the file at relPath should be transferred.
+func (f *Filter) Match(relPath string, info os.FileInfo, now time.Time) bool {
+    if f == nil {
+        return true
+    }
+    relPath = filepath.ToSlash(relPath)
+
+    if len(f.extensions) > 0 {
+        ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(relPath), "."))
+        if !contains(f.extensions, ext) {
+            return false
+        }
+    }
+    if len(f.include) > 0 && !matchAny(f.include, relPath) {
+        return false
+    }
+    if matchAny(f.exclude, relPath) {
+        return false
+    }
+
+    if f.minSize > 0 && info.Size() < f.minSize {
+        return false
+    }
+    if f.maxSize > 0 && info.Size() > f.maxSize {
+        return false
+    }
+    age := now.Sub(info.ModTime())
+    if f.minAge > 0 && age < f.minAge {
+        return false
+    }
+    if f.maxAge > 0 && age > f.maxAge {
+        return false
+    }
+    return true
+}
+
+// Skip reports whether the folder at relPath is excluded, so it need not be
+// walked.
+func (f *Filter) Skip(relPath string) bool {
+    return f != nil && matchAny(f.exclude, filepath.ToSlash(relPath))
+}
+
+func matchAny(patterns []*regexp.Regexp, relPath string) bool {
+    for _, re := range patterns {
+        if re.MatchString(relPath) {
+            return true
+        }
+    }
+    return false
+}
+
+// tooDeep reports whether the folder at relPath is more than maxDepth
+// levels below the folder being transferred. A maxDepth of 0 is no limit.
+func tooDeep(relPath string, maxDepth int) bool {
+    return maxDepth > 0 && strings.Count(filepath.ToSlash(relPath), "/")+1 > maxDepth
+}
@@ -0,0 +1,154 @@
+package sftp
+
+import (
+    "crypto/ed25519"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// NewHostKeyCallback builds the host key check for a customer connection.
+// When fingerprints (comma-separated, "SHA256:..." as printed by ssh-keygen -l)
+// are set, the server key must match one of them. When knownHostsFile is set,
+// the key must also match the OpenSSH known_hosts entry for the host. With
+// trustOnFirstUse, an unknown host is recorded in knownHostsFile and accepted,
+// but a host whose recorded key later changes is rejected.
+func NewHostKeyCallback(knownHostsFile, fingerprints string, trustOnFirstUse bool, logStream *log.Logger) (ssh.HostKeyCallback, error) {
+    pinned := []string{}
+    for _, fingerprint := range strings.Split(fingerprints, ",") {
+        if fingerprint = strings.TrimSpace(fingerprint); fingerprint != "" {
+            pinned = append(pinned, fingerprint)
+        }
+    }
+
+    if trustOnFirstUse && knownHostsFile == "" {
+        return nil, errors.New("TrustOnFirstUse requires KnownHostsFile")
+    }
+
+    if len(pinned) == 0 && knownHostsFile == "" {
+        logStream.Printf("WARNING: no KnownHostsFile or HostKeyFingerprints configured, host key is not verified")
+        return ssh.InsecureIgnoreHostKey(), nil
+    }
+
+    return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+        fingerprint := ssh.FingerprintSHA256(key)
+
+        if len(pinned) > 0 && !contains(pinned, fingerprint) {
+            logStream.Printf("Host key mismatch for %s: got %s, pinned %s", hostname, fingerprint, strings.Join(pinned, ", "))
+            return fmt.Errorf("host key mismatch for %s: got %s, not a pinned fingerprint", hostname, fingerprint)
+        }
+
+        if knownHostsFile == "" {
+            return nil
+        }
+
+        if trustOnFirstUse {
+            if _, err := os.Stat(knownHostsFile); os.IsNotExist(err) {
+                if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0700); err != nil {
+                    return err
+                }
+                if err := os.WriteFile(knownHostsFile, nil, 0600); err != nil {
+                    return err
+                }
+            }
+        }
+
+        checkKnownHosts, err := knownhosts.New(knownHostsFile)
+        if err != nil {
+            return err
+        }
+
+        err = checkKnownHosts(hostname, remote, key)
+        var keyErr *knownhosts.KeyError
+        if !errors.As(err, &keyErr) {
+            return err
+        }
+
+        if len(keyErr.Want) > 0 {
+            logStream.Printf("Host key mismatch for %s: got %s %s, known_hosts %s:%d expects %s", hostname, key.Type(), fingerprint, keyErr.Want[0].Filename, keyErr.Want[0].Line, ssh.FingerprintSHA256(keyErr.Want[0].Key))
+            return fmt.Errorf("host key mismatch for %s: got %s, known_hosts expects %s", hostname, fingerprint, ssh.FingerprintSHA256(keyErr.Want[0].Key))
+        }
+
+        if !trustOnFirstUse {
+            logStream.Printf("Host %s is not in %s (key %s %s)", hostname, knownHostsFile, key.Type(), fingerprint)
+            return fmt.Errorf("host key for %s is unknown: %s not in %s", hostname, fingerprint, knownHostsFile)
+        }
+
+        return trustHostKey(knownHostsFile, hostname, remote, key, logStream)
+    }, nil
+}
+
+// trustHostKey appends the key of a first-seen host to knownHostsFile.
+func trustHostKey(knownHostsFile, hostname string, remote net.Addr, key ssh.PublicKey, logStream *log.Logger) error {
+    addresses := []string{knownhosts.Normalize(hostname)}
+    if remote != nil && knownhosts.Normalize(remote.String()) != addresses[0] {
+        addresses = append(addresses, knownhosts.Normalize(remote.String()))
+    }
+
+    file, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    if _, err := file.WriteString(knownhosts.Line(addresses, key) + "\n"); err != nil {
+        return err
+    }
+
+    logStream.Printf("Trusted new host key for %s on first use: %s %s (recorded in %s)", hostname, key.Type(), ssh.FingerprintSHA256(key), knownHostsFile)
+    return nil
+}
+
+// KnownHostKeyAlgorithms returns the host key algorithms for the key types
+// knownHostsFile records for address ("host:port"). Offering only those makes
+// the server present a key that can be checked. The ssh package prefers ECDSA
+// over Ed25519, and known_hosts files often hold only the Ed25519 key. It
+// returns nil when the host has no entry or the file cannot be read, which
+// leaves the ssh package defaults.
+func KnownHostKeyAlgorithms(knownHostsFile, address string) []string {
+    checkKnownHosts, err := knownhosts.New(knownHostsFile)
+    if err != nil {
+        return nil
+    }
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        return nil
+    }
+    remote := &net.TCPAddr{IP: net.ParseIP(host)}
+    if remote.IP == nil {
+        remote.IP = net.IPv4zero
+    }
+    remote.Port, _ = strconv.Atoi(port)
+
+    // No recorded key matches an all-zero key, so the error lists them all.
+    probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+    if err != nil {
+        return nil
+    }
+    var keyErr *knownhosts.KeyError
+    if !errors.As(checkKnownHosts(address, remote, probe), &keyErr) {
+        return nil
+    }
+
+    var algorithms []string
+    for _, known := range keyErr.Want {
+        keyAlgorithms := []string{known.Key.Type()}
+        if known.Key.Type() == ssh.KeyAlgoRSA {
+            keyAlgorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+        }
+        for _, algorithm := range keyAlgorithms {
+            if !contains(algorithms, algorithm) {
+                algorithms = append(algorithms, algorithm)
+            }
+        }
+    }
+    return algorithms
+}
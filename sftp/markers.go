@@ -0,0 +1,26 @@
+package sftp
+
+import "strings"
+
+// MarkerPolicy describes the sentinel files partners use to say a data file
+// is complete, such as foo.csv.done next to foo.csv.
+type MarkerPolicy struct {
+    Source      string // Only transfer a file once a marker with this suffix is beside it
+    Destination string // Write an empty marker with this suffix beside each file once it is in place
+    Cleanup     string // "delete" (the default) removes the source marker after the transfer, "keep" leaves it
+}
+
+// isMarker reports whether name is a source marker rather than data.
+func (p MarkerPolicy) isMarker(name string) bool {
+    return p.Source != "" && strings.HasSuffix(name, p.Source)
+}
+
+// ready reports whether the file called name may be transferred, given the
+// names of the files in its folder.
+func (p MarkerPolicy) ready(name string, names map[string]bool) bool {
+    return p.Source == "" || names[name+p.Source]
+}
+
+func (p MarkerPolicy) deleteSource() bool {
+    return p.Source != "" && !strings.EqualFold(strings.TrimSpace(p.Cleanup), "keep")
+}
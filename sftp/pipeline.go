@@ -0,0 +1,187 @@
+package sftp
+
+import (
+    "errors"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// transferJob is one file for a transfer worker.
+type transferJob struct {
+    source  string      // File to transfer, local for uploads and remote for downloads
+    target  string      // Where a download is written; uploads work theirs out when staging
+    relPath string      // source relative to the folder being transferred
+    info    os.FileInfo // As found by the scan
+    hash    string      // Set when a sync compares by hash
+}
+
+// pipeline is what uploads and downloads share: walking the source folder
+// for the files the options select, leaving out those a sync has already
+// transferred, and handing the rest to workers with a session each.
+type pipeline struct {
+    verb      string // "uploading" or "downloading", for the log
+    clients   []*Client
+    workers   int
+    dryRun    bool
+    rootOnly  bool
+    maxDepth  int
+    flatten   bool
+    filter    *Filter
+    markers   MarkerPolicy
+    stability StabilityPolicy
+    sync      *SyncState
+
+    readDir  func(dir string) ([]os.FileInfo, error)
+    newJob   func(dir, relPath string, info os.FileInfo) transferJob
+    hash     func(job transferJob) (string, error) // When a sync compares by hash
+    transfer func(client *Client, job transferJob) error
+    copies   string             // Where the copies are, for the log
+    remove   func(string) error // Deletes a copy whose source is gone
+}
+
+// run transfers the selected files under root with p.workers workers,
+// recording each source file in results. A worker uses the same session
+// for all of its files.
+func (p pipeline) run(root string, logStream *log.Logger, results *Results) error {
+    workers := p.workers
+    if workers < 1 {
+        workers = 1
+    }
+
+    jobs := make(chan transferJob, workers)
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func(client *Client) {
+            defer wg.Done()
+            for job := range jobs {
+                err := p.transfer(client, job)
+                if errors.Is(err, errSkipped) {
+                    results.addSkipped(job.source)
+                    continue
+                }
+                if err != nil {
+                    logStream.Printf("Error %s file %s: %s", p.verb, job.source, err)
+                    results.addFailed(job.source, err)
+                    continue
+                }
+                if !p.dryRun {
+                    results.addSucceeded(job.source)
+                }
+            }
+        }(p.clients[i%len(p.clients)])
+    }
+
+    emit := func(job transferJob) { jobs <- job }
+    var found []transferJob
+    if p.stability.enabled() {
+        // Every file is scanned before any is transferred, so the stability
+        // check can compare two scans of the whole folder.
+        emit = func(job transferJob) { found = append(found, job) }
+    }
+    if p.sync != nil {
+        next := emit
+        emit = func(job transferJob) {
+            if p.sync.ByHash {
+                hash, err := p.hash(job)
+                if err != nil {
+                    logStream.Printf("Failed to hash %s, comparing its size and time: %v", job.source, err)
+                }
+                job.hash = hash
+            }
+            current := FileState{Size: job.info.Size(), ModTime: job.info.ModTime(), Hash: job.hash}
+            if p.sync.unchanged(job.relPath, current) {
+                results.addUnchanged(job.source)
+                return
+            }
+            next(job)
+        }
+    }
+    if p.flatten {
+        next := emit
+        claimed := make(map[string]string)
+        emit = func(job transferJob) {
+            name := filepath.Base(job.relPath)
+            if first, ok := claimed[name]; ok {
+                logStream.Printf("Skipping %s: flattening gives it the same name as %s", job.source, first)
+                results.addSkipped(job.source)
+                return
+            }
+            claimed[name] = job.source
+            next(job)
+        }
+    }
+
+    err := p.walk(root, "", emit)
+    if p.stability.enabled() {
+        for _, job := range stableJobs(found, p.stability, logStream, results) {
+            jobs <- job
+        }
+    }
+    close(jobs)
+    wg.Wait()
+    if err == nil && p.sync != nil {
+        // Only after a complete scan, or files in folders that failed to
+        // list would look deleted.
+        syncDeletions(p.sync, p.dryRun, p.copies, p.remove, logStream, results)
+    }
+    return err
+}
+
+// walk lists dir, which is relDir under the folder being transferred, and
+// emits a job for each file to transfer, as the folders are listed.
+func (p pipeline) walk(dir, relDir string, emit func(transferJob)) error {
+    files, err := p.readDir(dir)
+    if err != nil {
+        return err
+    }
+    names := make(map[string]bool)
+    for _, file := range files {
+        names[file.Name()] = true
+    }
+
+    for _, file := range files {
+        relPath := filepath.Join(relDir, file.Name())
+        if file.IsDir() {
+            if p.rootOnly || tooDeep(relPath, p.maxDepth) || p.filter.Skip(relPath) {
+                p.sync.seeFolder(relPath)
+                continue
+            }
+            if err := p.walk(filepath.Join(dir, file.Name()), relPath, emit); err != nil {
+                return err
+            }
+        } else if !p.markers.isMarker(file.Name()) {
+            // Seen even when not transferred this run, so a sync does not
+            // take it for deleted.
+            p.sync.see(relPath)
+            if p.markers.ready(file.Name(), names) && p.filter.Match(relPath, file, time.Now()) {
+                emit(p.newJob(dir, relPath, file))
+            }
+        }
+    }
+    return nil
+}
+
+// readLocalDir lists a local folder like client.ReadDir lists a remote one.
+// Files removed while it is listed are left out.
+func readLocalDir(dir string) ([]os.FileInfo, error) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    files := make([]os.FileInfo, 0, len(entries))
+    for _, entry := range entries {
+        info, err := entry.Info()
+        if errors.Is(err, os.ErrNotExist) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, info)
+    }
+    return files, nil
+}
@@ -0,0 +1,117 @@
+package sftp
+
+import "sync"
+
+// FileError is a file that could not be transferred.
+type FileError struct {
+    File string
+    Err  error
+}
+
+// Results collects the outcome of each file in a transfer run. It is safe
+// for use by concurrent transfer workers.
+type Results struct {
+    mu        sync.Mutex
+    succeeded []string
+    failed    []FileError
+    deferred  []string
+    skipped   []string
+    conflicts []Conflict
+    unchanged []string
+    deleted   []string
+}
+
+func (r *Results) addSucceeded(file string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.succeeded = append(r.succeeded, file)
+}
+
+func (r *Results) addFailed(file string, err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.failed = append(r.failed, FileError{File: file, Err: err})
+}
+
+func (r *Results) addDeferred(file string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.deferred = append(r.deferred, file)
+}
+
+func (r *Results) addSkipped(file string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.skipped = append(r.skipped, file)
+}
+
+func (r *Results) addConflict(conflict Conflict) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.conflicts = append(r.conflicts, conflict)
+}
+
+func (r *Results) addUnchanged(file string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.unchanged = append(r.unchanged, file)
+}
+
+func (r *Results) addDeleted(file string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.deleted = append(r.deleted, file)
+}
+
+// Succeeded returns the files that were transferred, in completion order.
+func (r *Results) Succeeded() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]string{}, r.succeeded...)
+}
+
+// Failed returns the files that could not be transferred and why.
+func (r *Results) Failed() []FileError {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]FileError{}, r.failed...)
+}
+
+// Deferred returns the files left for a later run because they were not
+// ready yet.
+func (r *Results) Deferred() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]string{}, r.deferred...)
+}
+
+// Skipped returns the files deliberately not transferred, such as those
+// whose remote copy was kept by the conflict policy.
+func (r *Results) Skipped() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]string{}, r.skipped...)
+}
+
+// Conflicts returns what was decided for each file whose destination was
+// already taken.
+func (r *Results) Conflicts() []Conflict {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]Conflict{}, r.conflicts...)
+}
+
+// Unchanged returns the files a sync left alone because they were already
+// transferred as they are.
+func (r *Results) Unchanged() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]string{}, r.unchanged...)
+}
+
+// Deleted returns the copies a sync deleted because their source was gone.
+func (r *Results) Deleted() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]string{}, r.deleted...)
+}
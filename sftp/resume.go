@@ -0,0 +1,146 @@
+package sftp
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "log"
+    "os"
+
+    "github.com/pkg/sftp"
+)
+
+// resumeCheckSize is how much of the end of a partial file is compared with
+// the source before the transfer is continued from there.
+const resumeCheckSize = 64 * 1024
+
+// uploadResumeOffset returns how much of local is already in remoteFile from
+// an interrupted upload, or 0 to start over. The partial file is trusted when
+// its last resumeCheckSize bytes match the local file at the same offset.
+func uploadResumeOffset(client *Client, remoteFile string, local *os.File, logStream *log.Logger) (int64, error) {
+    offset, mismatch, err := matchPartialUpload(client, remoteFile, local)
+    if mismatch != "" {
+        logStream.Printf("Remote %s %s %s, uploading it again", remoteFile, mismatch, local.Name())
+    }
+    return offset, err
+}
+
+// matchPartialUpload returns the size of remoteFile when it can be resumed
+// from, and otherwise 0 and, if it exists, why not.
+func matchPartialUpload(client *Client, remoteFile string, local *os.File) (int64, string, error) {
+    remoteInfo, err := client.Stat(remoteFile)
+    if errors.Is(err, os.ErrNotExist) {
+        return 0, "", nil
+    }
+    if err != nil {
+        return 0, "", err
+    }
+    localInfo, err := local.Stat()
+    if err != nil {
+        return 0, "", err
+    }
+
+    size := remoteInfo.Size()
+    if size == 0 {
+        return 0, "", nil
+    }
+    if size > localInfo.Size() {
+        return 0, "is larger than", nil
+    }
+
+    remote, err := client.Open(remoteFile)
+    if err != nil {
+        return 0, "", err
+    }
+    defer remote.Close()
+
+    same, err := sameTail(remote, local, size)
+    if err != nil {
+        return 0, "", err
+    }
+    if !same {
+        return 0, "does not match the start of", nil
+    }
+    return size, "", nil
+}
+
+// partialUpload reports whether remoteFile is what an interrupted upload of
+// localFile left behind: shorter than it and matching it where it ends.
+func partialUpload(client *Client, remoteFile, localFile string) bool {
+    local, err := os.Open(localFile)
+    if err != nil {
+        return false
+    }
+    defer local.Close()
+    info, err := local.Stat()
+    if err != nil {
+        return false
+    }
+    offset, _, err := matchPartialUpload(client, remoteFile, local)
+    return err == nil && offset > 0 && offset < info.Size()
+}
+
+// sameTail reports whether a and b hold the same bytes in the
+// resumeCheckSize bytes before end.
+func sameTail(a, b io.ReaderAt, end int64) (bool, error) {
+    start := end - resumeCheckSize
+    if start < 0 {
+        start = 0
+    }
+    bufA := make([]byte, end-start)
+    bufB := make([]byte, end-start)
+    if _, err := a.ReadAt(bufA, start); err != nil && err != io.EOF {
+        return false, err
+    }
+    if _, err := b.ReadAt(bufB, start); err != nil && err != io.EOF {
+        return false, err
+    }
+    return bytes.Equal(bufA, bufB), nil
+}
+
+// DefaultPartSuffix is appended to the local name of a file while it is
+// being downloaded.
+const DefaultPartSuffix = ".part"
+
+// downloadResumeOffset returns how much of remote is already in partFile
+// from an interrupted download, or 0 to start over. The partial file is
+// trusted when its last resumeCheckSize bytes match remote at the same
+// offset.
+func downloadResumeOffset(remote *sftp.File, partFile string, logStream *log.Logger) (int64, error) {
+    partInfo, err := os.Stat(partFile)
+    if errors.Is(err, os.ErrNotExist) {
+        return 0, nil
+    }
+    if err != nil {
+        return 0, err
+    }
+    remoteInfo, err := remote.Stat()
+    if err != nil {
+        return 0, err
+    }
+
+    size := partInfo.Size()
+    if size == 0 {
+        return 0, nil
+    }
+    if size > remoteInfo.Size() {
+        logStream.Printf("%s is larger than %s, downloading it again", partFile, remote.Name())
+        return 0, nil
+    }
+
+    part, err := os.Open(partFile)
+    if err != nil {
+        return 0, err
+    }
+    defer part.Close()
+
+    same, err := sameTail(remote, part, size)
+    if err != nil {
+        return 0, err
+    }
+    if !same {
+        logStream.Printf("%s does not match the start of %s, downloading it again", partFile, remote.Name())
+        return 0, nil
+    }
+    return size, nil
+}
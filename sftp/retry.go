@@ -0,0 +1,93 @@
+package sftp
+
+import (
+    "errors"
+    "io"
+    "log"
+    "math/rand"
+    "net"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// RetryPolicy controls how often a failed connection is retried. Zero
+// values mean a single attempt, a 5 second first backoff and a 5 minute cap.
+// Jitter is the fraction (0-1) of each backoff that is randomised.
+type RetryPolicy struct {
+    MaxAttempts    int
+    InitialBackoff time.Duration
+    MaxBackoff     time.Duration
+    Jitter         float64
+}
+
+// ConnectWithRetry calls connect until it succeeds, fails with an error that
+// is not transient, or policy.MaxAttempts is reached. The backoff doubles
+// after each attempt. Every attempt is written to logStream.
+func ConnectWithRetry(policy RetryPolicy, address string, logStream *log.Logger, connect func() (*Client, error)) (*Client, error) {
+    if policy.MaxAttempts <= 0 {
+        policy.MaxAttempts = 1
+    }
+    if policy.InitialBackoff <= 0 {
+        policy.InitialBackoff = 5 * time.Second
+    }
+    if policy.MaxBackoff <= 0 {
+        policy.MaxBackoff = 5 * time.Minute
+    }
+
+    backoff := policy.InitialBackoff
+    for attempt := 1; ; attempt++ {
+        logStream.Printf("Connecting to %s (attempt %d/%d)", address, attempt, policy.MaxAttempts)
+        client, err := connect()
+        if err == nil {
+            return client, nil
+        }
+
+        if attempt >= policy.MaxAttempts {
+            logStream.Printf("Attempt %d/%d to connect to %s failed: %v", attempt, policy.MaxAttempts, address, err)
+            return nil, err
+        }
+        if !IsTransient(err) {
+            logStream.Printf("Attempt %d/%d to connect to %s failed, not retrying: %v", attempt, policy.MaxAttempts, address, err)
+            return nil, err
+        }
+
+        wait := backoff
+        if policy.Jitter > 0 {
+            wait += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(backoff))
+        }
+        logStream.Printf("Attempt %d/%d to connect to %s failed: %v; retrying in %s", attempt, policy.MaxAttempts, address, err, wait.Round(time.Millisecond))
+        time.Sleep(wait)
+
+        backoff *= 2
+        if backoff > policy.MaxBackoff {
+            backoff = policy.MaxBackoff
+        }
+    }
+}
+
+// IsTransient reports whether err looks like a network failure that may go
+// away on its own, such as a refused or reset connection or a timeout, as
+// opposed to an authentication or host key failure.
+func IsTransient(err error) bool {
+    if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+        errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EHOSTUNREACH) ||
+        errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EPIPE) ||
+        errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return true
+    }
+
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return true
+    }
+
+    // The ssh package flattens handshake errors into strings.
+    message := err.Error()
+    for _, transient := range []string{"connection refused", "connection reset", "broken pipe", "i/o timeout", "timed out", "EOF"} {
+        if strings.Contains(message, transient) {
+            return true
+        }
+    }
+    return false
+}
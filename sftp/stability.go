@@ -0,0 +1,78 @@
+package sftp
+
+import (
+    "log"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// StabilityPolicy decides whether a local file has finished being written
+// and can be uploaded. Files that are not stable yet are left for the next
+// run.
+type StabilityPolicy struct {
+    MinAge     time.Duration // Time since the file was last modified
+    Interval   time.Duration // Scan again after this long and require the same size and mtime
+    CheckLocks bool          // Defer files that are flock'ed or open for writing
+}
+
+func (p StabilityPolicy) enabled() bool {
+    return p.MinAge > 0 || p.Interval > 0 || p.CheckLocks
+}
+
+// stableJobs returns the jobs whose files are stable under policy, and
+// records the others in results as deferred.
+func stableJobs(jobs []transferJob, policy StabilityPolicy, logStream *log.Logger, results *Results) []transferJob {
+    if policy.Interval > 0 && len(jobs) > 0 {
+        time.Sleep(policy.Interval)
+    }
+
+    var writing map[string]bool
+    if policy.CheckLocks {
+        writing = openForWriting()
+    }
+
+    stable := []transferJob{}
+    for _, job := range jobs {
+        reason := unstableReason(job, policy, writing)
+        if reason != "" {
+            logStream.Printf("Deferring %s to the next run: %s", job.source, reason)
+            results.addDeferred(job.source)
+            continue
+        }
+        stable = append(stable, job)
+    }
+    return stable
+}
+
+func unstableReason(job transferJob, policy StabilityPolicy, writing map[string]bool) string {
+    info := job.info
+    if policy.Interval > 0 {
+        current, err := os.Stat(job.source)
+        if err != nil {
+            return err.Error()
+        }
+        if current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+            return "still changing"
+        }
+        info = current
+    }
+
+    if age := time.Since(info.ModTime()); age < policy.MinAge {
+        return "modified " + age.Round(time.Second).String() + " ago"
+    }
+
+    if policy.CheckLocks {
+        if abs, err := filepath.Abs(job.source); err == nil && writing[abs] {
+            return "open for writing by another process"
+        }
+        locked, err := flocked(job.source)
+        if err != nil {
+            return err.Error()
+        }
+        if locked {
+            return "locked by another process"
+        }
+    }
+    return ""
+}
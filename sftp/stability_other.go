@@ -0,0 +1,15 @@
+//go:build !unix || aix || solaris
+
+package sftp
+
+// flocked always reports false where flock is not available. On Windows a
+// file being written is usually opened without read sharing, so the upload
+// fails and the file is retried on the next run anyway.
+func flocked(path string) (bool, error) {
+    return false, nil
+}
+
+// openForWriting is not supported on this platform.
+func openForWriting() map[string]bool {
+    return nil
+}
@@ -0,0 +1,72 @@
+//go:build unix && !aix && !solaris
+
+package sftp
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// flocked reports whether another process holds a flock on path.
+func flocked(path string) (bool, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return false, err
+    }
+    defer f.Close()
+
+    err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    if errors.Is(err, syscall.EWOULDBLOCK) {
+        return true, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return false, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// openForWriting returns the files other processes have open for writing,
+// from /proc. It is empty where there is no /proc or the processes belong
+// to other users.
+func openForWriting() map[string]bool {
+    writing := make(map[string]bool)
+    procs, err := os.ReadDir("/proc")
+    if err != nil {
+        return writing
+    }
+    for _, proc := range procs {
+        if _, err := strconv.Atoi(proc.Name()); err != nil {
+            continue
+        }
+        fdDir := filepath.Join("/proc", proc.Name(), "fd")
+        fds, err := os.ReadDir(fdDir)
+        if err != nil {
+            continue
+        }
+        for _, fd := range fds {
+            target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+            if err != nil || !filepath.IsAbs(target) {
+                continue
+            }
+            fdInfo, err := os.ReadFile(filepath.Join("/proc", proc.Name(), "fdinfo", fd.Name()))
+            if err != nil {
+                continue
+            }
+            for _, line := range strings.Split(string(fdInfo), "\n") {
+                value, ok := strings.CutPrefix(line, "flags:")
+                if !ok {
+                    continue
+                }
+                flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 64)
+                if err == nil && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+                    writing[target] = true
+                }
+            }
+        }
+    }
+    return writing
+}
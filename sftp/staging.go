@@ -0,0 +1,71 @@
+package sftp
+
+import (
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// DefaultNameTemplate publishes files under their local name.
+const DefaultNameTemplate = "{name}{ext}"
+
+// stagingPaths returns where the file at relPath is written during upload
+// and the path it is published under in remotePath. They are the same when
+// no staging is configured.
+func stagingPaths(remotePath, relPath string, options UploadOptions, now time.Time) (string, string) {
+    if options.Flatten {
+        relPath = filepath.Base(relPath)
+    }
+    staged := options.UseTempFolder || options.PartSuffix != ""
+    final := filepath.Join(remotePath, filepath.Dir(relPath), finalName(filepath.Base(relPath), options, staged, now))
+
+    switch {
+    case options.UseTempFolder:
+        return filepath.Join(options.TempRemotePath, relPath), final
+    case options.PartSuffix != "":
+        // The local name, so a resumed upload finds it again on a later run.
+        return filepath.Join(remotePath, relPath) + options.PartSuffix, final
+    default:
+        return final, final
+    }
+}
+
+// finalName fills in options.NameTemplate for a file called base. The
+// template may use {name} (base without its extension), {ext} (the
+// extension with its dot, or NewExtension for staged uploads), {date}
+// (YYYYMMDD) and {time} (HHMMSS).
+func finalName(base string, options UploadOptions, staged bool, now time.Time) string {
+    template := options.NameTemplate
+    if template == "" {
+        template = DefaultNameTemplate
+    }
+    ext := filepath.Ext(base)
+    name := strings.TrimSuffix(base, ext)
+    if staged && options.NewExtension != "" {
+        ext = options.NewExtension
+    }
+    return strings.NewReplacer(
+        "{name}", name,
+        "{ext}", ext,
+        "{date}", now.Format("20060102"),
+        "{time}", now.Format("150405"),
+    ).Replace(template)
+}
+
+// publish moves a staged upload to its final path. With posix-rename an
+// existing file there is replaced atomically; plain SFTP rename refuses to
+// overwrite, so without it the old file has to be removed first.
+func publish(client *Client, staged, final string, attributes FileAttributes) error {
+    if err := attributes.mkdirRemote(client, filepath.Dir(final)); err != nil {
+        return err
+    }
+    if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+        return client.PosixRename(staged, final)
+    }
+    if _, err := client.Stat(final); err == nil {
+        if err := client.Remove(final); err != nil {
+            return err
+        }
+    }
+    return client.Rename(staged, final)
+}
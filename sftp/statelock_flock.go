@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sftp
+
+import (
+    "errors"
+    "os"
+    "syscall"
+)
+
+// lockFile holds an exclusive lock on path until the returned function is
+// called. The system drops the lock when its process exits, so a job that
+// crashes does not leave the state locked.
+func lockFile(path string) (func(), error) {
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+    if err != nil {
+        return nil, err
+    }
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+        f.Close()
+        if errors.Is(err, syscall.EWOULDBLOCK) {
+            return nil, ErrStateLocked
+        }
+        return nil, err
+    }
+    return func() { f.Close() }, nil
+}
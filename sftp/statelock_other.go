@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package sftp
+
+import (
+    "errors"
+    "os"
+)
+
+// lockFile creates path as a lock, and removes it when the returned
+// function is called. A job that crashes leaves it behind, and it then has
+// to be removed by hand.
+func lockFile(path string) (func(), error) {
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+    if errors.Is(err, os.ErrExist) {
+        return nil, ErrStateLocked
+    }
+    if err != nil {
+        return nil, err
+    }
+    f.Close()
+    return func() { os.Remove(path) }, nil
+}
@@ -0,0 +1,271 @@
+package sftp
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// FileState is what a sync last transferred for one file.
+type FileState struct {
+    Size        int64
+    ModTime     time.Time
+    Hash        string `json:",omitempty"` // "algorithm:hex", when comparing by hash
+    Destination string // Where the copy was written
+}
+
+// SyncState remembers what a customer's sync has transferred, keyed by the
+// path relative to the folder being synced, so that later runs only send
+// new and changed files. It is kept in a JSON file between runs.
+type SyncState struct {
+    ByHash           bool // Compare contents by hash instead of size and modification time
+    PropagateDeletes bool // Delete the copy of a file that is gone from the source
+
+    path   string
+    unlock func()
+    mu     sync.Mutex
+    files  map[string]FileState
+    seen   map[string]bool
+}
+
+// ErrStateLocked is returned by LockSyncState while another process holds
+// the state.
+var ErrStateLocked = errors.New("sync state is in use by another process")
+
+// LoadSyncState reads the state kept in path. A missing file is an empty
+// state, as on a customer's first sync.
+func LoadSyncState(path string) (*SyncState, error) {
+    s := &SyncState{path: path, files: make(map[string]FileState), seen: make(map[string]bool)}
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return s, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &s.files); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// LockSyncState reads the state kept in path like LoadSyncState, and holds
+// a lock beside it so that no other process changes the state until
+// Unlock. It returns ErrStateLocked if another process holds the lock.
+func LockSyncState(path string) (*SyncState, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return nil, err
+    }
+    unlock, err := lockFile(path + ".lock")
+    if err != nil {
+        return nil, err
+    }
+    s, err := LoadSyncState(path)
+    if err != nil {
+        unlock()
+        return nil, err
+    }
+    s.unlock = unlock
+    return s, nil
+}
+
+// Unlock releases the lock taken by LockSyncState. Safe on a nil state and
+// on one that was only loaded.
+func (s *SyncState) Unlock() {
+    if s == nil || s.unlock == nil {
+        return
+    }
+    s.unlock()
+    s.unlock = nil
+}
+
+// Save writes the state back to its file, replacing it atomically.
+func (s *SyncState) Save() error {
+    s.mu.Lock()
+    data, err := json.MarshalIndent(s.files, "", "  ")
+    s.mu.Unlock()
+    if err != nil {
+        return err
+    }
+
+    if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+        return err
+    }
+    tmp := s.path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, s.path)
+}
+
+// see notes that relPath still exists at the source. Safe on a nil state.
+func (s *SyncState) see(relPath string) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.seen[filepath.ToSlash(relPath)] = true
+}
+
+// seeFolder notes that relDir was left out of this run rather than
+// deleted, so the files recorded under it are kept. Safe on a nil state.
+func (s *SyncState) seeFolder(relDir string) {
+    if s == nil {
+        return
+    }
+    prefix := filepath.ToSlash(relDir) + "/"
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for relPath := range s.files {
+        if strings.HasPrefix(relPath, prefix) {
+            s.seen[relPath] = true
+        }
+    }
+}
+
+// unchanged reports whether relPath was already transferred as current.
+func (s *SyncState) unchanged(relPath string, current FileState) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    last, ok := s.files[filepath.ToSlash(relPath)]
+    if !ok {
+        return false
+    }
+    if s.ByHash && current.Hash != "" && last.Hash != "" {
+        return current.Hash == last.Hash
+    }
+    return current.Size == last.Size && current.ModTime.Equal(last.ModTime)
+}
+
+// sent reports whether destination is the copy last written for relPath.
+// Safe on a nil state.
+func (s *SyncState) sent(relPath, destination string) bool {
+    if s == nil {
+        return false
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.files[filepath.ToSlash(relPath)].Destination == destination
+}
+
+func (s *SyncState) record(relPath string, state FileState) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.files[filepath.ToSlash(relPath)] = state
+}
+
+// gone returns the transferred files not seen at the source this run, in
+// path order.
+func (s *SyncState) gone() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    gone := []string{}
+    for relPath := range s.files {
+        if !s.seen[relPath] {
+            gone = append(gone, relPath)
+        }
+    }
+    sort.Strings(gone)
+    return gone
+}
+
+func (s *SyncState) forget(relPath string) (FileState, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    state, ok := s.files[relPath]
+    delete(s.files, relPath)
+    return state, ok
+}
+
+// Files returns what has been transferred, by relative path.
+func (s *SyncState) Files() map[string]FileState {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    files := make(map[string]FileState, len(s.files))
+    for relPath, state := range s.files {
+        files[relPath] = state
+    }
+    return files
+}
+
+// Forget drops the files whose relative path matches pattern, a glob or a
+// "re:" expression as in IncludePatterns, so that the next run transfers
+// them again. An empty pattern forgets every file. It returns the paths
+// forgotten, in order.
+func (s *SyncState) Forget(pattern string) ([]string, error) {
+    patterns, err := compilePatterns([]string{pattern})
+    if err != nil {
+        return nil, err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    forgotten := []string{}
+    for relPath := range s.files {
+        if len(patterns) == 0 || matchAny(patterns, relPath) {
+            forgotten = append(forgotten, relPath)
+            delete(s.files, relPath)
+        }
+    }
+    sort.Strings(forgotten)
+    return forgotten, nil
+}
+
+// localHash returns the "sha256:hex" hash of a local file.
+func localHash(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    sum, err := hashReader(f, "sha256")
+    if err != nil {
+        return "", err
+    }
+    return "sha256:" + hex.EncodeToString(sum), nil
+}
+
+// remoteHash returns the "algorithm:hex" hash of a remote file, or "" when
+// the server cannot hash files for us, so that the file is compared by size
+// and modification time instead of being downloaded just to hash it.
+func remoteHash(client *Client, path string) string {
+    algorithm, sum, err := client.checkFile(path)
+    if err != nil {
+        return ""
+    }
+    return algorithm + ":" + hex.EncodeToString(sum)
+}
+
+// syncDeletions forgets the files that are gone from the source and, when
+// the state propagates deletes, removes their copies with remove.
+func syncDeletions(s *SyncState, dryRun bool, where string, remove func(string) error, logStream *log.Logger, results *Results) {
+    for _, relPath := range s.gone() {
+        if dryRun {
+            if s.PropagateDeletes {
+                logStream.Printf("Dry run: would delete %s from %s", s.files[relPath].Destination, where)
+            }
+            continue
+        }
+        state, _ := s.forget(relPath)
+        if !s.PropagateDeletes {
+            continue
+        }
+        if err := remove(state.Destination); err != nil && !errors.Is(err, os.ErrNotExist) {
+            logStream.Printf("Failed to delete %s from %s: %v", state.Destination, where, err)
+            results.addFailed(state.Destination, err)
+            // Keep it, so the delete is tried again next run.
+            s.record(relPath, state)
+            continue
+        }
+        logStream.Printf("Deleted %s from %s, its source %s is gone", state.Destination, where, relPath)
+        results.addDeleted(state.Destination)
+    }
+}
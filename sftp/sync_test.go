@@ -0,0 +1,262 @@
+package sftp
+
+import (
+    "errors"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// syncFixture is a local and a remote folder, both on this machine, served
+// by a test SFTP server, and the state file of a sync between them.
+type syncFixture struct {
+    client    *Client
+    local     string
+    remote    string
+    statePath string
+}
+
+func newSyncFixture(t *testing.T) syncFixture {
+    t.Helper()
+    address := startTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, 0)
+    client, err := dialTestServer(t, address, nil, Throughput{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { client.Close() })
+
+    dir := t.TempDir()
+    f := syncFixture{
+        client:    client,
+        local:     filepath.Join(dir, "local"),
+        remote:    filepath.Join(dir, "remote"),
+        statePath: filepath.Join(dir, "state.json"),
+    }
+    for _, path := range []string{f.local, f.remote} {
+        if err := os.Mkdir(path, 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return f
+}
+
+// loadState reads the state as a new run would, with deletions on.
+func (f syncFixture) loadState(t *testing.T) *SyncState {
+    t.Helper()
+    state, err := LoadSyncState(f.statePath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    state.PropagateDeletes = true
+    return state
+}
+
+// upload runs one sync from local to remote with options and saves the state.
+func (f syncFixture) upload(t *testing.T, options UploadOptions) *Results {
+    t.Helper()
+    options.Sync = f.loadState(t)
+    results := &Results{}
+    if err := UploadDirectory(f.client, f.local, f.remote, options, log.New(io.Discard, "", 0), results); err != nil {
+        t.Fatal(err)
+    }
+    if err := options.Sync.Save(); err != nil {
+        t.Fatal(err)
+    }
+    return results
+}
+
+// download runs one sync from remote to local with options and saves the
+// state.
+func (f syncFixture) download(t *testing.T, options DownloadOptions) *Results {
+    t.Helper()
+    options.Sync = f.loadState(t)
+    results := &Results{}
+    if err := DownloadDirectory(f.client, f.local, f.remote, options, log.New(io.Discard, "", 0), results); err != nil {
+        t.Fatal(err)
+    }
+    if err := options.Sync.Save(); err != nil {
+        t.Fatal(err)
+    }
+    return results
+}
+
+func writeFiles(t *testing.T, root string, relPaths ...string) {
+    t.Helper()
+    for _, relPath := range relPaths {
+        path := filepath.Join(root, relPath)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(relPath), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func assertExists(t *testing.T, path string, want bool) {
+    t.Helper()
+    _, err := os.Stat(path)
+    if exists := err == nil; exists != want {
+        t.Errorf("%s exists = %v, want %v", path, exists, want)
+    }
+}
+
+func TestSyncUploadSkipsUnchangedFiles(t *testing.T) {
+    f := newSyncFixture(t)
+    writeFiles(t, f.local, "a.txt", "sub/b.txt")
+
+    if results := f.upload(t, UploadOptions{}); len(results.Succeeded()) != 2 {
+        t.Fatalf("first run uploaded %v, want both files", results.Succeeded())
+    }
+    results := f.upload(t, UploadOptions{})
+    if len(results.Succeeded()) != 0 || len(results.Unchanged()) != 2 {
+        t.Fatalf("second run uploaded %v and left %v unchanged, want nothing uploaded", results.Succeeded(), results.Unchanged())
+    }
+
+    if err := os.WriteFile(filepath.Join(f.local, "a.txt"), []byte("changed"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    results = f.upload(t, UploadOptions{})
+    if got := results.Succeeded(); len(got) != 1 || got[0] != filepath.Join(f.local, "a.txt") {
+        t.Fatalf("after a change uploaded %v, want only a.txt", got)
+    }
+    if len(results.Conflicts()) != 0 {
+        t.Errorf("updating a synced file reported conflicts %v", results.Conflicts())
+    }
+    data, err := os.ReadFile(filepath.Join(f.remote, "a.txt"))
+    if err != nil || string(data) != "changed" {
+        t.Errorf("remote a.txt = %q, %v, want the changed content", data, err)
+    }
+}
+
+func TestSyncUploadDeletesRemovedFiles(t *testing.T) {
+    f := newSyncFixture(t)
+    writeFiles(t, f.local, "a.txt", "sub/b.txt")
+    f.upload(t, UploadOptions{})
+
+    if err := os.Remove(filepath.Join(f.local, "sub", "b.txt")); err != nil {
+        t.Fatal(err)
+    }
+    results := f.upload(t, UploadOptions{})
+    if got := results.Deleted(); len(got) != 1 || got[0] != filepath.Join(f.remote, "sub", "b.txt") {
+        t.Fatalf("deleted %v, want the remote sub/b.txt", got)
+    }
+    assertExists(t, filepath.Join(f.remote, "sub", "b.txt"), false)
+    assertExists(t, filepath.Join(f.remote, "a.txt"), true)
+}
+
+func TestSyncUploadDryRunDeletesNothing(t *testing.T) {
+    f := newSyncFixture(t)
+    writeFiles(t, f.local, "a.txt")
+    f.upload(t, UploadOptions{})
+
+    if err := os.Remove(filepath.Join(f.local, "a.txt")); err != nil {
+        t.Fatal(err)
+    }
+    results := f.upload(t, UploadOptions{DryRun: true})
+    if len(results.Deleted()) != 0 {
+        t.Errorf("dry run deleted %v", results.Deleted())
+    }
+    assertExists(t, filepath.Join(f.remote, "a.txt"), true)
+}
+
+// TestSyncKeepsFilesLeftOut checks that narrowing the selection rules does
+// not delete the copies of files the rules no longer cover.
+func TestSyncKeepsFilesLeftOut(t *testing.T) {
+    filter, err := NewFilter("", nil, []string{"sub"}, 0, 0, 0, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    onlyCSV, err := NewFilter("csv", nil, nil, 0, 0, 0, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rules := []struct {
+        name     string
+        upload   UploadOptions
+        download DownloadOptions
+    }{
+        {"excluded folder", UploadOptions{Filter: filter}, DownloadOptions{Filter: filter}},
+        {"excluded file", UploadOptions{Filter: onlyCSV}, DownloadOptions{Filter: onlyCSV}},
+        {"root only", UploadOptions{UploadRootOnly: true}, DownloadOptions{DownloadRootOnly: true}},
+        {"max depth", UploadOptions{MaxDepth: 1}, DownloadOptions{MaxDepth: 1}},
+        {"source marker", UploadOptions{Markers: MarkerPolicy{Source: ".done"}}, DownloadOptions{Markers: MarkerPolicy{Source: ".done"}}},
+    }
+    for _, rule := range rules {
+        t.Run("upload "+rule.name, func(t *testing.T) {
+            f := newSyncFixture(t)
+            writeFiles(t, f.local, "a.txt", "sub/b.txt", "deep/er/c.txt")
+            f.upload(t, UploadOptions{})
+
+            results := f.upload(t, rule.upload)
+            if len(results.Deleted()) != 0 {
+                t.Errorf("deleted %v", results.Deleted())
+            }
+            for _, relPath := range []string{"a.txt", "sub/b.txt", "deep/er/c.txt"} {
+                assertExists(t, filepath.Join(f.remote, relPath), true)
+            }
+            if files := f.loadState(t).Files(); len(files) != 3 {
+                t.Errorf("state holds %d files, want all 3 kept", len(files))
+            }
+        })
+        t.Run("download "+rule.name, func(t *testing.T) {
+            f := newSyncFixture(t)
+            writeFiles(t, f.remote, "a.txt", "sub/b.txt", "deep/er/c.txt")
+            f.download(t, DownloadOptions{})
+
+            results := f.download(t, rule.download)
+            if len(results.Deleted()) != 0 {
+                t.Errorf("deleted %v", results.Deleted())
+            }
+            for _, relPath := range []string{"a.txt", "sub/b.txt", "deep/er/c.txt"} {
+                assertExists(t, filepath.Join(f.local, relPath), true)
+            }
+        })
+    }
+}
+
+func TestSyncDownload(t *testing.T) {
+    f := newSyncFixture(t)
+    writeFiles(t, f.remote, "a.txt", "sub/b.txt")
+
+    if results := f.download(t, DownloadOptions{}); len(results.Succeeded()) != 2 {
+        t.Fatalf("first run downloaded %v, want both files", results.Succeeded())
+    }
+    results := f.download(t, DownloadOptions{})
+    if len(results.Succeeded()) != 0 || len(results.Unchanged()) != 2 {
+        t.Fatalf("second run downloaded %v and left %v unchanged, want nothing downloaded", results.Succeeded(), results.Unchanged())
+    }
+    assertExists(t, filepath.Join(f.remote, "a.txt"), true)
+
+    if err := os.Remove(filepath.Join(f.remote, "a.txt")); err != nil {
+        t.Fatal(err)
+    }
+    results = f.download(t, DownloadOptions{})
+    if got := results.Deleted(); len(got) != 1 || got[0] != filepath.Join(f.local, "a.txt") {
+        t.Fatalf("deleted %v, want the local a.txt", got)
+    }
+    assertExists(t, filepath.Join(f.local, "a.txt"), false)
+    assertExists(t, filepath.Join(f.local, "sub", "b.txt"), true)
+}
+
+func TestLockSyncState(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state", "customer.json")
+    state, err := LockSyncState(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := LockSyncState(path); !errors.Is(err, ErrStateLocked) {
+        t.Fatalf("second lock returned %v, want ErrStateLocked", err)
+    }
+
+    state.Unlock()
+    again, err := LockSyncState(path)
+    if err != nil {
+        t.Fatalf("lock after Unlock: %v", err)
+    }
+    again.Unlock()
+}
@@ -0,0 +1,164 @@
+package sftp
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "io"
+    "log"
+    "net"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+)
+
+// startTestServer runs an SSH server on a loopback port that logs users in
+// with config and serves SFTP from the local filesystem. Everything it sends
+// arrives latency late, as over a long link. It returns the server's address.
+func startTestServer(t testing.TB, config *ssh.ServerConfig, latency time.Duration) string {
+    t.Helper()
+    return startWrappedTestServer(t, config, latency, nil)
+}
+
+// startWrappedTestServer is startTestServer with each SFTP session passed
+// through wrap, when it is not nil, before pkg/sftp serves it.
+func startWrappedTestServer(t testing.TB, config *ssh.ServerConfig, latency time.Duration, wrap func(ssh.Channel) io.ReadWriteCloser) string {
+    t.Helper()
+    _, hostKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signer, err := ssh.NewSignerFromKey(hostKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    config.AddHostKey(signer)
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            if latency > 0 {
+                conn = newDelayedConn(conn, latency)
+            }
+            go serveTestConn(conn, config, wrap)
+        }
+    }()
+    return listener.Addr().String()
+}
+
+func serveTestConn(conn net.Conn, config *ssh.ServerConfig, wrap func(ssh.Channel) io.ReadWriteCloser) {
+    _, channels, requests, err := ssh.NewServerConn(conn, config)
+    if err != nil {
+        conn.Close()
+        return
+    }
+    go ssh.DiscardRequests(requests)
+
+    for newChannel := range channels {
+        if newChannel.ChannelType() != "session" {
+            newChannel.Reject(ssh.UnknownChannelType, "only sessions are served")
+            continue
+        }
+        channel, requests, err := newChannel.Accept()
+        if err != nil {
+            continue
+        }
+        go func() {
+            for request := range requests {
+                ok := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+                request.Reply(ok, nil)
+                if !ok {
+                    continue
+                }
+                var session io.ReadWriteCloser = channel
+                if wrap != nil {
+                    session = wrap(channel)
+                }
+                server, err := sftp.NewServer(session)
+                if err != nil {
+                    channel.Close()
+                    return
+                }
+                go func() {
+                    server.Serve()
+                    channel.Close()
+                }()
+            }
+        }()
+    }
+}
+
+// delayedConn holds back each write for a fixed delay without limiting the
+// bandwidth, so that only requests in flight at the same time overlap.
+type delayedConn struct {
+    net.Conn
+    delay  time.Duration
+    writes chan delayedWrite
+    closed chan struct{}
+    once   sync.Once
+}
+
+type delayedWrite struct {
+    due  time.Time
+    data []byte
+}
+
+func newDelayedConn(conn net.Conn, delay time.Duration) *delayedConn {
+    c := &delayedConn{Conn: conn, delay: delay, writes: make(chan delayedWrite, 1024), closed: make(chan struct{})}
+    go func() {
+        for {
+            select {
+            case w := <-c.writes:
+                time.Sleep(time.Until(w.due))
+                if _, err := c.Conn.Write(w.data); err != nil {
+                    c.Close()
+                    return
+                }
+            case <-c.closed:
+                return
+            }
+        }
+    }()
+    return c
+}
+
+func (c *delayedConn) Write(p []byte) (int, error) {
+    select {
+    case c.writes <- delayedWrite{due: time.Now().Add(c.delay), data: append([]byte{}, p...)}:
+        return len(p), nil
+    case <-c.closed:
+        return 0, net.ErrClosed
+    }
+}
+
+func (c *delayedConn) Close() error {
+    c.once.Do(func() { close(c.closed) })
+    return c.Conn.Close()
+}
+
+// dialTestServer logs in to the server at address with auth.
+func dialTestServer(t testing.TB, address string, auth []ssh.AuthMethod, throughput Throughput) (*Client, error) {
+    t.Helper()
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    portNumber, err := strconv.Atoi(port)
+    if err != nil {
+        t.Fatal(err)
+    }
+    hop := NewHop("test", auth, host, portNumber, ssh.InsecureIgnoreHostKey(), Algorithms{})
+    return NewSFTPClient(&net.Dialer{}, hop, nil, Timeouts{}, throughput, log.New(io.Discard, "", 0))
+}
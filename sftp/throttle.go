@@ -0,0 +1,160 @@
+package sftp
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "time"
+)
+
+// BandwidthWindow limits transfers to LimitKBps between Start and End
+// (local time, "HH:MM"). A window whose End is before its Start runs past
+// midnight. A LimitKBps of 0 means unlimited.
+type BandwidthWindow struct {
+    Start     string
+    End       string
+    LimitKBps int
+}
+
+type window struct {
+    start, end time.Duration // since midnight
+    limitKBps  int
+}
+
+// Throttle limits the bandwidth of the transfers it is shared by. Its limit
+// comes from the first schedule window covering the current time, or from
+// the default limit outside all windows. A parent throttle, such as a global
+// cap shared by all customers, applies on top.
+type Throttle struct {
+    mu        sync.Mutex
+    limitKBps int
+    schedule  []window
+    parent    *Throttle
+    allowance float64 // Bytes that may be sent without waiting, negative when in debt
+    last      time.Time
+}
+
+// NewThrottle returns a throttle with limitKBps outside the schedule. It
+// returns parent unchanged when there is nothing to limit.
+func NewThrottle(limitKBps int, schedule []BandwidthWindow, parent *Throttle) (*Throttle, error) {
+    if limitKBps <= 0 && len(schedule) == 0 {
+        return parent, nil
+    }
+
+    t := &Throttle{limitKBps: limitKBps, parent: parent}
+    for _, w := range schedule {
+        start, err := parseClock(w.Start)
+        if err != nil {
+            return nil, err
+        }
+        end, err := parseClock(w.End)
+        if err != nil {
+            return nil, err
+        }
+        t.schedule = append(t.schedule, window{start: start, end: end, limitKBps: w.LimitKBps})
+    }
+    return t, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+    parsed, err := time.Parse("15:04", clock)
+    if err != nil {
+        return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", clock)
+    }
+    return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// bytesPerSecond returns the limit in effect at now, 0 meaning unlimited.
+func (t *Throttle) bytesPerSecond(now time.Time) float64 {
+    limitKBps := t.limitKBps
+    clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+    for _, w := range t.schedule {
+        inside := clock >= w.start && clock < w.end
+        if w.end <= w.start {
+            inside = clock >= w.start || clock < w.end
+        }
+        if inside {
+            limitKBps = w.limitKBps
+            break
+        }
+    }
+    if limitKBps <= 0 {
+        return 0
+    }
+    return float64(limitKBps) * 1024
+}
+
+// wait blocks until n more bytes may be transferred.
+func (t *Throttle) wait(n int) {
+    for ; t != nil; t = t.parent {
+        t.mu.Lock()
+        now := time.Now()
+        rate := t.bytesPerSecond(now)
+        if rate == 0 {
+            t.allowance = 0
+            t.last = now
+            t.mu.Unlock()
+            continue
+        }
+
+        if !t.last.IsZero() {
+            t.allowance += now.Sub(t.last).Seconds() * rate
+        }
+        if t.allowance > rate {
+            t.allowance = rate // At most one second of burst
+        }
+        t.last = now
+        t.allowance -= float64(n)
+        debt := t.allowance
+        t.mu.Unlock()
+
+        if debt < 0 {
+            time.Sleep(time.Duration(-debt / rate * float64(time.Second)))
+        }
+    }
+}
+
+// throttledReader limits how fast an upload reads its local file. Stat is
+// passed through so pkg/sftp can still size concurrent writes.
+type throttledReader struct {
+    file     *os.File
+    throttle *Throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+    if len(p) > 32*1024 {
+        p = p[:32*1024]
+    }
+    n, err := r.file.Read(p)
+    r.throttle.wait(n)
+    return n, err
+}
+
+func (r *throttledReader) Stat() (os.FileInfo, error) {
+    return r.file.Stat()
+}
+
+// throttledWriter limits how fast a download writes its local file.
+type throttledWriter struct {
+    w        io.Writer
+    throttle *Throttle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        chunk := p
+        if len(chunk) > 32*1024 {
+            chunk = chunk[:32*1024]
+        }
+        w.throttle.wait(len(chunk))
+        n, err := w.w.Write(chunk)
+        written += n
+        if err != nil {
+            return written, err
+        }
+        p = p[n:]
+    }
+    return written, nil
+}
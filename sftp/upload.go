@@ -1,86 +1,187 @@
 package sftp
 
 import (
+    "io"
     "log"
     "os"
     "path/filepath"
-    "strings"
+    "time"
 
     "github.com/pkg/sftp"
 )
 
-func UploadDirectory(client *sftp.Client, localPath, remotePath, tempRemotePath, fileExtensions, newExtension string, logStream *log.Logger, uploadedFiles *[]string, uploadRootOnly, useTempFolder bool) error {
-    allowedExtensions := strings.Split(fileExtensions, ",")
+// UploadOptions are the per-customer settings for UploadDirectory.
+type UploadOptions struct {
+    TempRemotePath string  // Folder files are uploaded to before being moved into place
+    PartSuffix     string  // Without a temp folder, upload under the local name plus this suffix
+    NameTemplate   string  // Final name, e.g. "{name}_{date}{ext}"
+    Filter         *Filter // Files to upload, nil for all
+    DryRun         bool    // Only log what would be uploaded
+    NewExtension   string  // Extension of a staged file once it is moved into place
+    UploadRootOnly bool
+    MaxDepth       int  // Levels of subfolders to upload, 0 for all
+    Flatten        bool // Upload every file into remotePath itself
+    UseTempFolder  bool
+    Resume         bool // Continue interrupted uploads instead of starting over
+    Stability      StabilityPolicy
+    Markers        MarkerPolicy   // Local source markers, remote destination markers
+    OnConflict     ConflictPolicy // What to do when the remote file exists, default overwrite
+    Attributes     FileAttributes
+    Checksums      bool      // Compare hashes as well as sizes after each upload
+    Workers        int       // Files uploaded at once, default 1
+    Pool           []*Client // Extra sessions the workers spread files over
+    Throttle       *Throttle
+    Sync           *SyncState // Only upload new and changed files, nil to upload all
+}
+
+// UploadDirectory uploads the matching files under localPath to remotePath
+// with options.Workers workers, recording each file in results. A worker
+// uses client, or one of options.Pool, for all of its files.
+func UploadDirectory(client *Client, localPath, remotePath string, options UploadOptions, logStream *log.Logger, results *Results) error {
+    p := pipeline{
+        verb:      "uploading",
+        clients:   append([]*Client{client}, options.Pool...),
+        workers:   options.Workers,
+        dryRun:    options.DryRun,
+        rootOnly:  options.UploadRootOnly,
+        maxDepth:  options.MaxDepth,
+        flatten:   options.Flatten,
+        filter:    options.Filter,
+        markers:   options.Markers,
+        stability: options.Stability,
+        sync:      options.Sync,
+        readDir:   readLocalDir,
+        newJob: func(dir, relPath string, info os.FileInfo) transferJob {
+            return transferJob{source: filepath.Join(dir, info.Name()), relPath: relPath, info: info}
+        },
+        hash: func(job transferJob) (string, error) {
+            return localHash(job.source)
+        },
+        transfer: func(client *Client, job transferJob) error {
+            return uploadFile(client, job, remotePath, options, logStream, results)
+        },
+        copies: "remote server",
+        remove: client.Remove,
+    }
+    return p.run(localPath, logStream, results)
+}
+
+// uploadFile uploads the job's file to its relative path under remotePath,
+// after applying the conflict policy. When staging is configured it is
+// first written to the temp folder or under a part suffix, and only moved
+// to its final name once it is complete.
+func uploadFile(client *Client, job transferJob, remotePath string, options UploadOptions, logStream *log.Logger, results *Results) error {
+    localFile := job.source
+    now := time.Now()
+    remoteFile, finalFile := stagingPaths(remotePath, job.relPath, options, now)
 
-    files, err := os.ReadDir(localPath)
+    target, decision := finalFile, ""
+    var err error
+    // A sync updating its own earlier copy is not a conflict, and neither
+    // is the partial copy an interrupted upload left there to resume.
+    resumable := options.Resume && remoteFile == finalFile && partialUpload(client, finalFile, localFile)
+    if !options.Sync.sent(job.relPath, finalFile) && !resumable {
+        target, decision, err = resolveConflict(client, job.info, finalFile, options.OnConflict, now)
+    }
+    if decision != "" {
+        logStream.Printf("Conflict uploading %s: %s exists, %s", localFile, finalFile, decision)
+        results.addConflict(Conflict{File: localFile, RemoteFile: finalFile, Decision: decision})
+    }
     if err != nil {
         return err
     }
+    if remoteFile == finalFile {
+        remoteFile = target
+    }
+    finalFile = target
 
-    for _, file := range files {
-        if file.IsDir() && !uploadRootOnly {
-            subDir := filepath.Join(localPath, file.Name())
-            remoteSubDir := filepath.Join(remotePath, file.Name())
-            err = UploadDirectory(client, subDir, remoteSubDir, tempRemotePath, fileExtensions, newExtension, logStream, uploadedFiles, uploadRootOnly, useTempFolder)
-            if err != nil {
-                return err
-            }
-        } else {
-            ext := strings.TrimPrefix(filepath.Ext(file.Name()), ".")
-            if fileExtensions == "" || contains(allowedExtensions, ext) {
-                localFile := filepath.Join(localPath, file.Name())
-                remoteFile := filepath.Join(remotePath, file.Name())
-
-                err := uploadFile(client, localFile, remoteFile, tempRemotePath, newExtension, logStream, uploadedFiles, useTempFolder)
-                if err != nil {
-                    logStream.Printf("Error uploading file %s: %s", localFile, err)
-                }
-            }
-        }
+    if options.DryRun {
+        logStream.Printf("Dry run: would upload %s to %s", localFile, finalFile)
+        return nil
     }
-    return nil
-}
 
-func uploadFile(client *sftp.Client, localFile, remoteFile, tempRemotePath, newExtension string, logStream *log.Logger, uploadedFiles *[]string, useTempFolder bool) error {
     srcFile, err := os.Open(localFile)
     if err != nil {
         return err
     }
     defer srcFile.Close()
 
-    if useTempFolder {
-        if err := client.MkdirAll(tempRemotePath); err != nil {
+    if err := options.Attributes.mkdirRemote(client, filepath.Dir(remoteFile)); err != nil {
+        return err
+    }
+
+    var offset int64
+    if options.Resume {
+        offset, err = uploadResumeOffset(client, remoteFile, srcFile, logStream)
+        if err != nil {
             return err
         }
-        remoteFile = filepath.Join(tempRemotePath, filepath.Base(localFile))
     }
 
-    dstFile, err := client.Create(remoteFile)
+    var dstFile *sftp.File
+    if offset > 0 {
+        logStream.Printf("Resuming upload of %s at %d bytes", localFile, offset)
+        dstFile, err = client.OpenFile(remoteFile, os.O_WRONLY)
+        if err == nil {
+            _, err = dstFile.Seek(offset, io.SeekStart)
+        }
+        if err == nil {
+            _, err = srcFile.Seek(offset, io.SeekStart)
+        }
+    } else {
+        dstFile, err = client.Create(remoteFile)
+    }
+    if dstFile != nil {
+        defer dstFile.Close()
+    }
     if err != nil {
         return err
     }
-    defer dstFile.Close()
 
-    if _, err := dstFile.ReadFrom(srcFile); err != nil {
+    var src io.Reader = srcFile
+    if options.Throttle != nil {
+        src = &throttledReader{file: srcFile, throttle: options.Throttle}
+    }
+
+    if _, err := dstFile.ReadFrom(src); err != nil {
+        return err
+    }
+
+    if err := dstFile.Close(); err != nil {
+        return err
+    }
+    if err := verifyCopy(client, remoteFile, localFile, options.Checksums, offset, client.Remove, remoteFile, logStream); err != nil {
         return err
     }
 
     logStream.Printf("Uploaded %s to %s", localFile, remoteFile)
-    *uploadedFiles = append(*uploadedFiles, localFile)
 
-    if useTempFolder {
-        // Rename file to change extension
-        remoteFileWithNewExtension := strings.TrimSuffix(remoteFile, filepath.Ext(remoteFile)) + newExtension
-        err := client.Rename(remoteFile, remoteFileWithNewExtension)
-        if err != nil {
+    if err := options.Attributes.applyRemote(client, remoteFile, job.info, logStream); err != nil {
+        return err
+    }
+
+    if remoteFile != finalFile {
+        if err := publish(client, remoteFile, finalFile, options.Attributes); err != nil {
             return err
         }
-        finalRemoteFile := filepath.Join(filepath.Dir(remoteFileWithNewExtension), filepath.Base(remoteFileWithNewExtension))
-        err = client.Rename(remoteFileWithNewExtension, finalRemoteFile)
+        logStream.Printf("Moved %s to %s", remoteFile, finalFile)
+    }
+
+    if options.Markers.Destination != "" {
+        marker, err := client.Create(finalFile + options.Markers.Destination)
         if err != nil {
             return err
         }
-        logStream.Printf("Moved %s to %s", remoteFileWithNewExtension, finalRemoteFile)
+        marker.Close()
+        logStream.Printf("Wrote marker %s", finalFile+options.Markers.Destination)
+    }
+    if options.Markers.deleteSource() {
+        if err := os.Remove(localFile + options.Markers.Source); err != nil {
+            logStream.Printf("Failed to remove marker %s: %v", localFile+options.Markers.Source, err)
+        }
+    }
+    if options.Sync != nil {
+        options.Sync.record(job.relPath, FileState{Size: job.info.Size(), ModTime: job.info.ModTime(), Hash: job.hash, Destination: finalFile})
     }
     return nil
 }
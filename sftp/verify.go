@@ -0,0 +1,238 @@
+package sftp
+
+import (
+    "bytes"
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "log"
+    "os"
+    "strings"
+)
+
+// checkFileHashes are the hashes asked for with check-file-name, strongest
+// first. The server picks the first one it supports.
+var checkFileHashes = []string{"sha512", "sha384", "sha256", "sha224", "sha1", "md5"}
+
+var newHash = map[string]func() hash.Hash{
+    "sha512": sha512.New,
+    "sha384": sha512.New384,
+    "sha256": sha256.New,
+    "sha224": sha256.New224,
+    "sha1":   sha1.New,
+    "md5":    md5.New,
+}
+
+// verifyTransfer checks that remoteFile and localFile have the same size
+// and, with checksums, the same hash. The hash comes from the server's check-file extension when it
+// has one, otherwise remoteFile is read back.
+func verifyTransfer(client *Client, remoteFile, localFile string, checksums bool, logStream *log.Logger) error {
+    remoteInfo, err := client.Stat(remoteFile)
+    if err != nil {
+        return err
+    }
+    localInfo, err := os.Stat(localFile)
+    if err != nil {
+        return err
+    }
+    if remoteInfo.Size() != localInfo.Size() {
+        return fmt.Errorf("verifying %s: remote size %d, local size %d", remoteFile, remoteInfo.Size(), localInfo.Size())
+    }
+    if !checksums {
+        return nil
+    }
+
+    algorithm, remoteSum, err := client.checkFile(remoteFile)
+    if err != nil {
+        if !errors.Is(err, errNoCheckFile) {
+            logStream.Printf("check-file failed for %s, reading it back instead: %v", remoteFile, err)
+        }
+        algorithm = "sha256"
+        remote, err := client.Open(remoteFile)
+        if err != nil {
+            return err
+        }
+        defer remote.Close()
+        remoteSum, err = hashReader(remote, algorithm)
+        if err != nil {
+            return err
+        }
+    }
+
+    local, err := os.Open(localFile)
+    if err != nil {
+        return err
+    }
+    defer local.Close()
+    localSum, err := hashReader(local, algorithm)
+    if err != nil {
+        return err
+    }
+
+    if !bytes.Equal(remoteSum, localSum) {
+        return fmt.Errorf("verifying %s: %s %s does not match %s of %s", remoteFile, algorithm, hex.EncodeToString(remoteSum), hex.EncodeToString(localSum), localFile)
+    }
+    logStream.Printf("Verified %s against %s (%s %s)", remoteFile, localFile, algorithm, hex.EncodeToString(localSum))
+    return nil
+}
+
+// verifyCopy checks a finished transfer with verifyTransfer. Hashes are
+// compared when checksums is set, and also when the transfer resumed at a
+// non-zero offset: the partial copy was only checked at its tail before
+// resuming, and an interrupted run with concurrent writes can leave holes
+// before that. A copy that fails is deleted with remove, so the next run
+// starts from scratch rather than resuming a bad copy.
+func verifyCopy(client *Client, remoteFile, localFile string, checksums bool, offset int64, remove func(string) error, copy string, logStream *log.Logger) error {
+    err := verifyTransfer(client, remoteFile, localFile, checksums || offset > 0, logStream)
+    if err != nil {
+        remove(copy)
+    }
+    return err
+}
+
+func hashReader(r io.Reader, algorithm string) ([]byte, error) {
+    newFunc, ok := newHash[algorithm]
+    if !ok {
+        return nil, fmt.Errorf("unsupported hash %q", algorithm)
+    }
+    h := newFunc()
+    if _, err := io.Copy(h, r); err != nil {
+        return nil, err
+    }
+    return h.Sum(nil), nil
+}
+
+var errNoCheckFile = errors.New("server does not support check-file")
+
+// SFTP packet types used by checkFile.
+const (
+    fxpInit          = 1
+    fxpVersion       = 2
+    fxpStatus        = 101
+    fxpExtended      = 200
+    fxpExtendedReply = 201
+)
+
+// checkFile asks the server to hash path with the check-file-name extension
+// (draft-ietf-secsh-filexfer-extensions). pkg/sftp cannot send arbitrary
+// extended requests, so this runs on a separate sftp subsystem session over
+// the same SSH connection.
+func (c *Client) checkFile(path string) (string, []byte, error) {
+    _, checkFile := c.HasExtension("check-file")
+    _, checkFileName := c.HasExtension("check-file-name")
+    if !checkFile && !checkFileName {
+        return "", nil, errNoCheckFile
+    }
+
+    session, err := c.conns[len(c.conns)-1].NewSession()
+    if err != nil {
+        return "", nil, err
+    }
+    defer session.Close()
+    w, err := session.StdinPipe()
+    if err != nil {
+        return "", nil, err
+    }
+    r, err := session.StdoutPipe()
+    if err != nil {
+        return "", nil, err
+    }
+    if err := session.RequestSubsystem("sftp"); err != nil {
+        return "", nil, err
+    }
+
+    if err := writePacket(w, fxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+        return "", nil, err
+    }
+    if typ, _, err := readPacket(r); err != nil {
+        return "", nil, err
+    } else if typ != fxpVersion {
+        return "", nil, fmt.Errorf("unexpected sftp packet type %d", typ)
+    }
+
+    request := binary.BigEndian.AppendUint32(nil, 1) // Request id
+    request = appendString(request, "check-file-name")
+    request = appendString(request, path)
+    request = appendString(request, strings.Join(checkFileHashes, ","))
+    request = binary.BigEndian.AppendUint64(request, 0) // From the start
+    request = binary.BigEndian.AppendUint64(request, 0) // To the end
+    request = binary.BigEndian.AppendUint32(request, 0) // One hash for the whole range
+    if err := writePacket(w, fxpExtended, request); err != nil {
+        return "", nil, err
+    }
+
+    typ, reply, err := readPacket(r)
+    if err != nil {
+        return "", nil, err
+    }
+    switch typ {
+    case fxpExtendedReply:
+        // Request id, "check-file", the hash used and the hash itself.
+        if len(reply) < 4 {
+            return "", nil, errors.New("short check-file reply")
+        }
+        _, rest, ok := readString(reply[4:])
+        if !ok {
+            return "", nil, errors.New("short check-file reply")
+        }
+        algorithm, sum, ok := readString(rest)
+        if !ok || newHash[algorithm] == nil || len(sum) != newHash[algorithm]().Size() {
+            return "", nil, fmt.Errorf("unexpected check-file reply for hash %q", algorithm)
+        }
+        return algorithm, sum, nil
+    case fxpStatus:
+        if len(reply) >= 8 {
+            return "", nil, fmt.Errorf("check-file-name %s: status %d", path, binary.BigEndian.Uint32(reply[4:]))
+        }
+        return "", nil, fmt.Errorf("check-file-name %s: failed", path)
+    default:
+        return "", nil, fmt.Errorf("unexpected sftp packet type %d", typ)
+    }
+}
+
+func writePacket(w io.Writer, typ byte, payload []byte) error {
+    packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+    packet = append(packet, typ)
+    packet = append(packet, payload...)
+    _, err := w.Write(packet)
+    return err
+}
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+    var header [4]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return 0, nil, err
+    }
+    length := binary.BigEndian.Uint32(header[:])
+    if length == 0 || length > 256*1024 {
+        return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+    }
+    packet := make([]byte, length)
+    if _, err := io.ReadFull(r, packet); err != nil {
+        return 0, nil, err
+    }
+    return packet[0], packet[1:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+    b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+    return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, bool) {
+    if len(b) < 4 {
+        return "", nil, false
+    }
+    n := binary.BigEndian.Uint32(b)
+    if uint32(len(b)-4) < n {
+        return "", nil, false
+    }
+    return string(b[4 : 4+n]), b[4+n:], true
+}
@@ -0,0 +1,208 @@
+package sftp
+
+import (
+    "bytes"
+    "crypto/sha512"
+    "encoding/binary"
+    "errors"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// checkFileSession answers check-file-name requests itself and passes every
+// other packet on to pkg/sftp, which has no check-file extension. The
+// version packet pkg/sftp sends is changed to offer the extension.
+type checkFileSession struct {
+    ssh.Channel
+    corrupt bool // Reply with a hash that does not match the file
+
+    mu      sync.Mutex // Keeps our replies and pkg/sftp's packets apart
+    offered bool
+    pending []byte
+}
+
+func (s *checkFileSession) Read(p []byte) (int, error) {
+    for len(s.pending) == 0 {
+        typ, payload, err := readPacket(s.Channel)
+        if err != nil {
+            return 0, err
+        }
+        if typ == fxpExtended && len(payload) > 4 {
+            if name, request, ok := readString(payload[4:]); ok && name == "check-file-name" {
+                if err := s.answer(payload[:4], request); err != nil {
+                    return 0, err
+                }
+                continue
+            }
+        }
+        s.pending = binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+        s.pending = append(append(s.pending, typ), payload...)
+    }
+    n := copy(p, s.pending)
+    s.pending = s.pending[n:]
+    return n, nil
+}
+
+// answer replies to the check-file-name request with id with the SHA-512
+// of the whole file, the first hash the client asks for.
+func (s *checkFileSession) answer(id, request []byte) error {
+    path, _, ok := readString(request)
+    if !ok {
+        return errors.New("short check-file-name request")
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        status := binary.BigEndian.AppendUint32(append([]byte{}, id...), 2) // No such file
+        status = appendString(appendString(status, err.Error()), "")
+        return s.writeReply(fxpStatus, status)
+    }
+    sum := sha512.Sum512(data)
+    if s.corrupt {
+        sum[0] ^= 0xff
+    }
+    reply := appendString(append([]byte{}, id...), "check-file")
+    reply = appendString(reply, "sha512")
+    return s.writeReply(fxpExtendedReply, append(reply, sum[:]...))
+}
+
+func (s *checkFileSession) writeReply(typ byte, payload []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return writePacket(s.Channel, typ, payload)
+}
+
+func (s *checkFileSession) Write(p []byte) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.offered && len(p) > 4 && p[4] == fxpVersion {
+        s.offered = true
+        version := appendString(append([]byte{}, p[5:]...), "check-file-name")
+        if err := writePacket(s.Channel, fxpVersion, appendString(version, "1")); err != nil {
+            return 0, err
+        }
+        return len(p), nil
+    }
+    return s.Channel.Write(p)
+}
+
+// dialCheckFileServer logs in to a test server with the check-file
+// extension, which hashes files correctly unless corrupt is set.
+func dialCheckFileServer(t *testing.T, corrupt bool) *Client {
+    t.Helper()
+    address := startWrappedTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, 0, func(channel ssh.Channel) io.ReadWriteCloser {
+        return &checkFileSession{Channel: channel, corrupt: corrupt}
+    })
+    client, err := dialTestServer(t, address, nil, Throughput{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { client.Close() })
+    return client
+}
+
+func TestCheckFile(t *testing.T) {
+    dir := t.TempDir()
+    remoteFile := filepath.Join(dir, "remote.txt")
+    localFile := filepath.Join(dir, "local.txt")
+    for _, path := range []string{remoteFile, localFile} {
+        if err := os.WriteFile(path, []byte("the same contents"), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    logStream := log.New(io.Discard, "", 0)
+
+    client := dialCheckFileServer(t, false)
+    algorithm, sum, err := client.checkFile(remoteFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := sha512.Sum512([]byte("the same contents"))
+    if algorithm != "sha512" || !bytes.Equal(sum, want[:]) {
+        t.Errorf("checkFile = %s %x, want sha512 %x", algorithm, sum, want)
+    }
+    if err := verifyTransfer(client, remoteFile, localFile, true, logStream); err != nil {
+        t.Errorf("matching hash: %v", err)
+    }
+    if _, _, err := client.checkFile(filepath.Join(dir, "missing.txt")); err == nil || !strings.Contains(err.Error(), "status 2") {
+        t.Errorf("checkFile of a missing file returned %v, want status 2", err)
+    }
+
+    corrupt := dialCheckFileServer(t, true)
+    if err := verifyTransfer(corrupt, remoteFile, localFile, true, logStream); err == nil || !strings.Contains(err.Error(), "does not match") {
+        t.Errorf("mismatched hash returned %v, want a mismatch", err)
+    }
+    if err := verifyTransfer(corrupt, remoteFile, localFile, false, logStream); err != nil {
+        t.Errorf("size check without checksums: %v", err)
+    }
+}
+
+func TestCheckFileUnsupported(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "file.txt")
+    if err := os.WriteFile(file, []byte("contents"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    address := startTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, 0)
+    client, err := dialTestServer(t, address, nil, Throughput{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    if _, _, err := client.checkFile(file); !errors.Is(err, errNoCheckFile) {
+        t.Errorf("checkFile returned %v, want errNoCheckFile", err)
+    }
+    // The file is read back and hashed instead.
+    if err := verifyTransfer(client, file, file, true, log.New(io.Discard, "", 0)); err != nil {
+        t.Errorf("verifying by reading back: %v", err)
+    }
+}
+
+// TestFailedVerificationKeepsSources checks that a transfer whose hash does
+// not match is reported as failed, so the job neither archives the local
+// file of an upload nor deletes the remote file of a download.
+func TestFailedVerificationKeepsSources(t *testing.T) {
+    client := dialCheckFileServer(t, true)
+    logStream := log.New(io.Discard, "", 0)
+
+    t.Run("upload", func(t *testing.T) {
+        local, remote := t.TempDir(), t.TempDir()
+        writeFiles(t, local, "a.txt")
+        results := &Results{}
+        if err := UploadDirectory(client, local, remote, UploadOptions{Checksums: true}, logStream, results); err != nil {
+            t.Fatal(err)
+        }
+        if len(results.Succeeded()) != 0 || len(results.Failed()) != 1 {
+            t.Fatalf("succeeded %v, failed %v, want the upload failed", results.Succeeded(), results.Failed())
+        }
+        if err := results.Failed()[0].Err; !strings.Contains(err.Error(), "does not match") {
+            t.Errorf("failed with %v, want a hash mismatch", err)
+        }
+        assertExists(t, filepath.Join(local, "a.txt"), true)
+    })
+
+    t.Run("download", func(t *testing.T) {
+        local, remote := t.TempDir(), t.TempDir()
+        writeFiles(t, remote, "a.txt")
+        results := &Results{}
+        options := DownloadOptions{Checksums: true, DeleteAfterDownload: true}
+        if err := DownloadDirectory(client, local, remote, options, logStream, results); err != nil {
+            t.Fatal(err)
+        }
+        if len(results.Succeeded()) != 0 || len(results.Failed()) != 1 {
+            t.Fatalf("succeeded %v, failed %v, want the download failed", results.Succeeded(), results.Failed())
+        }
+        if err := results.Failed()[0].Err; !strings.Contains(err.Error(), "does not match") {
+            t.Errorf("failed with %v, want a hash mismatch", err)
+        }
+        assertExists(t, filepath.Join(remote, "a.txt"), true)
+        assertExists(t, filepath.Join(local, "a.txt"), false)
+    })
+}